@@ -1,12 +1,350 @@
 package cmd
 
-import "github.com/loicalbertin/sweetcher/pkg/log"
+import (
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/loicalbertin/sweetcher/pkg/log"
+	"github.com/loicalbertin/sweetcher/pkg/proxy"
+)
 
 // Config is the root of a configuration file
+//
+// Proxies definitions credentials may reference secrets instead of holding them in plaintext,
+// see secretRef for the supported references.
 type Config struct {
-	Server   Server             `json:"server,omitempty" mapstructure:"server"`
-	Proxies  map[string]string  `json:"proxies,omitempty" mapstructure:"proxies"`
-	Profiles map[string]Profile `json:"profiles,omitempty" mapstructure:"profiles"`
+	Server   Server                     `json:"server,omitempty" mapstructure:"server"`
+	Proxies  map[string]ProxyDefinition `json:"proxies,omitempty" mapstructure:"proxies"`
+	Profiles map[string]Profile         `json:"profiles,omitempty" mapstructure:"profiles"`
+}
+
+// unmarshalConfig decodes the configuration read by v
+func unmarshalConfig(v *viper.Viper) (*Config, error) {
+	c := &Config{}
+	err := v.Unmarshal(c, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		stringToProxyDefinitionHook,
+		// viper default hooks
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)))
+	return c, err
+}
+
+// stringToProxyDefinitionHook allows proxies to be defined by their URL only
+func stringToProxyDefinitionHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() == reflect.String && to == reflect.TypeOf(ProxyDefinition{}) {
+		return ProxyDefinition{URL: data.(string)}, nil
+	}
+	return data, nil
+}
+
+// LogValue implements slog.LogValuer to log the configuration without plaintext passwords
+func (c *Config) LogValue() slog.Value {
+	return slog.AnyValue(c.Redacted())
+}
+
+// Redacted returns a copy of the configuration where plaintext passwords of proxy definitions
+// and of the SOCKS listener are redacted
+func (c *Config) Redacted() Config {
+	redacted := *c
+	redacted.Proxies = make(map[string]ProxyDefinition, len(c.Proxies))
+	for name, definition := range c.Proxies {
+		definition.URL = redactProxyURL(definition.URL)
+		if definition.Auth.Password != "" && !isSecretRef(definition.Auth.Password) {
+			definition.Auth.Password = redactedSecret
+		}
+		if definition.SSH.KeyPassphrase != "" && !isSecretRef(definition.SSH.KeyPassphrase) {
+			definition.SSH.KeyPassphrase = redactedSecret
+		}
+		redacted.Proxies[name] = definition
+	}
+	if c.Server.Socks.Password != "" && !isSecretRef(c.Server.Socks.Password) {
+		redacted.Server.Socks.Password = redactedSecret
+	}
+	return redacted
+}
+
+// ProxyDefinition defines an upstream proxy
+//
+// It can be written as a plain URL string or as an object to set per proxy options.
+// Auth credentials take precedence over the user info of the URL.
+type ProxyDefinition struct {
+	URL  string    `json:"url,omitempty" mapstructure:"url"`
+	Auth ProxyAuth `json:"auth,omitempty" mapstructure:"auth"`
+	TLS  ProxyTLS  `json:"tls,omitempty" mapstructure:"tls"`
+	SSH  ProxySSH  `json:"ssh,omitempty" mapstructure:"ssh"`
+	// ConnectTimeout limits the time to connect to the proxy (ie. "10s"), no limit by default
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty" mapstructure:"connect_timeout"`
+	// HandshakeTimeout limits the TLS, SSH or SOCKS negotiation with the proxy, no limit by default
+	HandshakeTimeout time.Duration `json:"handshake_timeout,omitempty" mapstructure:"handshake_timeout"`
+	// ResponseTimeout limits the time waiting for the proxy to answer a request, no limit by default
+	ResponseTimeout time.Duration `json:"response_timeout,omitempty" mapstructure:"response_timeout"`
+	// IdleTimeout is how long idle connections to the proxy are kept for reuse, defaults to 90s
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty" mapstructure:"idle_timeout"`
+	// BindAddress is the local IP address connections to the proxy are made from
+	BindAddress string `json:"bind_address,omitempty" mapstructure:"bind_address"`
+	// HTTP2 multiplexes tunnels over a single connection to https proxies supporting it
+	HTTP2 bool `json:"http2,omitempty" mapstructure:"http2"`
+	// WarmConns is the number of connections to the proxy established ahead of tunnels
+	WarmConns int `json:"warm_conns,omitempty" mapstructure:"warm_conns"`
+	// MaxConns limits the concurrent connections through the proxy, others wait for one to be closed
+	MaxConns int `json:"max_conns,omitempty" mapstructure:"max_conns"`
+	// HealthCheck enables background probes of the proxy
+	HealthCheck *ProxyHealthCheck `json:"health_check,omitempty" mapstructure:"health_check"`
+	// CircuitBreaker makes connections through the proxy fail fast while it keeps failing
+	CircuitBreaker *ProxyCircuitBreaker `json:"circuit_breaker,omitempty" mapstructure:"circuit_breaker"`
+	// Chain is an ordered list of other proxies names, connections to each proxy of the chain
+	// are tunneled through the previous one. It is exclusive with URL.
+	Chain []string `json:"chain,omitempty" mapstructure:"chain"`
+	// Group is a list of other proxies names (or "direct") used as a single proxy according to the Strategy.
+	// It is exclusive with URL and Chain.
+	Group []string `json:"group,omitempty" mapstructure:"group"`
+	// Strategy defines the order in which group members are tried until one of them succeeds:
+	// "failover" (the default), "round_robin", "least_connections", "consistent_hash" or "latency".
+	Strategy string `json:"strategy,omitempty" mapstructure:"strategy"`
+	// CoolDown is how long failed members of a group are skipped (ie. "1m"), defaults to 30s
+	CoolDown time.Duration `json:"cool_down,omitempty" mapstructure:"cool_down"`
+}
+
+// ProxyAuth defines the credentials used to authenticate against a proxy
+//
+// Scheme forces the authentication scheme ("basic", "digest" or "ntlm"),
+// by default it is negotiated with the proxy.
+type ProxyAuth struct {
+	Scheme   string `json:"scheme,omitempty" mapstructure:"scheme"`
+	Username string `json:"username,omitempty" mapstructure:"username"`
+	Password string `json:"password,omitempty" mapstructure:"password"`
+}
+
+// ProxyTLS defines how to connect to https proxies
+//
+// Proxies certificates are verified using the system roots unless a CA file is given.
+type ProxyTLS struct {
+	// ServerName is sent in the TLS handshake and verified instead of the proxy hostname
+	ServerName string `json:"server_name,omitempty" mapstructure:"server_name"`
+	// CAFile is a PEM bundle of certificate authorities trusted for this proxy
+	CAFile string `json:"ca_file,omitempty" mapstructure:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate and key for proxies requiring mutual TLS
+	CertFile string `json:"cert_file,omitempty" mapstructure:"cert_file"`
+	KeyFile  string `json:"key_file,omitempty" mapstructure:"key_file"`
+	// Pins are SHA-256 fingerprints of accepted proxy certificates (ie. "AB:CD:...")
+	Pins []string `json:"pins,omitempty" mapstructure:"pins"`
+	// InsecureSkipVerify disables the verification of the proxy certificate, pins are still checked
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty" mapstructure:"insecure_skip_verify"`
+}
+
+// ProxySSH defines how to connect to ssh proxies
+//
+// Keys of the SSH agent are used unless a key file is given, host keys are verified with ~/.ssh/known_hosts
+// unless another known_hosts file is given. A password may also be given as the proxy URL password.
+type ProxySSH struct {
+	// KeyFile is a PEM private key (ie. ~/.ssh/id_ed25519)
+	KeyFile string `json:"key_file,omitempty" mapstructure:"key_file"`
+	// KeyPassphrase decrypts the key file, it may be a secret reference
+	KeyPassphrase string `json:"key_passphrase,omitempty" mapstructure:"key_passphrase"`
+	// Agent uses the keys of the SSH agent in addition to the key file
+	Agent bool `json:"agent,omitempty" mapstructure:"agent"`
+	// KnownHostsFile is an OpenSSH known_hosts file used to verify the proxy host key
+	KnownHostsFile string `json:"known_hosts_file,omitempty" mapstructure:"known_hosts_file"`
+	// InsecureIgnoreHostKey disables the verification of the proxy host key
+	InsecureIgnoreHostKey bool `json:"insecure_ignore_host_key,omitempty" mapstructure:"insecure_ignore_host_key"`
+	// KeepAlive is the interval of the keepalives detecting broken connections, defaults to 30s
+	KeepAlive time.Duration `json:"keep_alive,omitempty" mapstructure:"keep_alive"`
+}
+
+// ProxyHealthCheck defines how a proxy is probed in the background, groups skip members that are down
+type ProxyHealthCheck struct {
+	// Kind is "tcp" (the default) to connect to the proxy, "connect" to open a tunnel to Target
+	// or "http" to get the Target URL through the proxy
+	Kind   string `json:"kind,omitempty" mapstructure:"kind"`
+	Target string `json:"target,omitempty" mapstructure:"target"`
+	// Interval between probes, defaults to 30s
+	Interval time.Duration `json:"interval,omitempty" mapstructure:"interval"`
+	// Timeout of probes, defaults to 5s
+	Timeout time.Duration `json:"timeout,omitempty" mapstructure:"timeout"`
+	// Rise is the number of successful probes for a proxy to be up again, defaults to 2
+	Rise int `json:"rise,omitempty" mapstructure:"rise"`
+	// Fall is the number of failed probes for a proxy to be down, defaults to 3
+	Fall int `json:"fall,omitempty" mapstructure:"fall"`
+}
+
+// ProxyCircuitBreaker defines when connections through a proxy fail fast, groups fall back to their other members
+type ProxyCircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the circuit, defaults to 5
+	Threshold int `json:"threshold,omitempty" mapstructure:"threshold"`
+	// OpenDuration is how long connections fail fast before trying the proxy again, defaults to 30s
+	OpenDuration time.Duration `json:"open_duration,omitempty" mapstructure:"open_duration"`
+}
+
+func (t ProxyTLS) isSet() bool {
+	return t.ServerName != "" || t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || len(t.Pins) > 0 || t.InsecureSkipVerify
+}
+
+func (s ProxySSH) isSet() bool {
+	return s.KeyFile != "" || s.KeyPassphrase != "" || s.Agent || s.KnownHostsFile != "" || s.InsecureIgnoreHostKey || s.KeepAlive != 0
+}
+
+// toSSHConfig creates the SSH configuration of an ssh proxy
+func (s ProxySSH) toSSHConfig() (*ssh.ClientConfig, error) {
+	passphrase, err := resolveSecretRefs(s.KeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	// without key file the agent is used by default
+	c, err := proxy.NewSSHConfig(proxy.SSHOptions{
+		KeyFile:               s.KeyFile,
+		KeyPassphrase:         passphrase,
+		Agent:                 s.Agent || s.KeyFile == "",
+		KnownHostsFile:        s.KnownHostsFile,
+		InsecureIgnoreHostKey: s.InsecureIgnoreHostKey,
+	})
+	return c, errors.Wrap(err, "invalid ssh options")
+}
+
+func (d ProxyDefinition) toUpstream() (*proxy.Upstream, error) {
+	if d.URL == "" {
+		return nil, errors.New("missing proxy url")
+	}
+	u, err := parseProxyURL(d.URL)
+	if err != nil {
+		return nil, err
+	}
+	if d.Auth.Username != "" || d.Auth.Password != "" {
+		user, err := resolveSecretRefs(d.Auth.Username)
+		if err != nil {
+			return nil, err
+		}
+		password, err := resolveSecretRefs(d.Auth.Password)
+		if err != nil {
+			return nil, err
+		}
+		u.User = url.UserPassword(user, password)
+	}
+	upstream := &proxy.Upstream{
+		URL:              u,
+		Auth:             strings.ToLower(d.Auth.Scheme),
+		ConnectTimeout:   d.ConnectTimeout,
+		HandshakeTimeout: d.HandshakeTimeout,
+		ResponseTimeout:  d.ResponseTimeout,
+		IdleTimeout:      d.IdleTimeout,
+		HTTP2:            d.HTTP2,
+		WarmConns:        d.WarmConns,
+		MaxConns:         d.MaxConns,
+	}
+	if d.TLS.isSet() {
+		upstream.TLSConfig, err = proxy.NewTLSConfig(proxy.TLSOptions{
+			CAFile:             d.TLS.CAFile,
+			CertFile:           d.TLS.CertFile,
+			KeyFile:            d.TLS.KeyFile,
+			Pins:               d.TLS.Pins,
+			ServerName:         d.TLS.ServerName,
+			InsecureSkipVerify: d.TLS.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid tls options")
+		}
+	}
+	if d.SSH.isSet() {
+		if u.Scheme != "ssh" {
+			return nil, errors.New("ssh options are only supported by ssh proxies")
+		}
+		upstream.SSHConfig, err = d.SSH.toSSHConfig()
+		if err != nil {
+			return nil, err
+		}
+		upstream.KeepAlive = d.SSH.KeepAlive
+	}
+	if d.HealthCheck != nil {
+		upstream.HealthCheck = &proxy.HealthCheck{
+			Kind:     proxy.HealthCheckKind(strings.ToLower(d.HealthCheck.Kind)),
+			Target:   d.HealthCheck.Target,
+			Interval: d.HealthCheck.Interval,
+			Timeout:  d.HealthCheck.Timeout,
+			Rise:     d.HealthCheck.Rise,
+			Fall:     d.HealthCheck.Fall,
+		}
+	}
+	if d.CircuitBreaker != nil {
+		upstream.CircuitBreaker = &proxy.CircuitBreaker{
+			Threshold:    d.CircuitBreaker.Threshold,
+			OpenDuration: d.CircuitBreaker.OpenDuration,
+		}
+	}
+	if d.BindAddress != "" {
+		upstream.BindAddress, err = netip.ParseAddr(d.BindAddress)
+		if err != nil {
+			return nil, errors.Errorf("invalid bind_address %q, should be an IP address", d.BindAddress)
+		}
+	}
+	return upstream, upstream.Validate()
+}
+
+// toChain creates the upstream of a chain definition from the definitions and upstreams of the other proxies
+//
+// The first proxy of the chain is shared with other profiles while the next ones are created
+// for the chain as they are reached through the previous ones.
+func (d ProxyDefinition) toChain(definitions map[string]ProxyDefinition, upstreams map[string]*proxy.Upstream) (*proxy.Upstream, error) {
+	if d.URL != "" || len(d.Group) > 0 {
+		return nil, errors.New("url, chain and group are mutually exclusive")
+	}
+	hops := make([]*proxy.Upstream, 0, len(d.Chain))
+	for i, name := range d.Chain {
+		definition, ok := definitions[name]
+		if !ok {
+			return nil, errors.Errorf("proxy %q of the chain not found", name)
+		}
+		if len(definition.Chain) > 0 {
+			return nil, errors.Errorf("proxy %q of the chain is itself a chain", name)
+		}
+		if i == 0 {
+			hops = append(hops, upstreams[name])
+			continue
+		}
+		hop, err := definition.toUpstream()
+		if err != nil {
+			return nil, errors.Wrapf(err, "malformed proxy %q of the chain", name)
+		}
+		hops = append(hops, hop)
+	}
+	return proxy.Chain(hops...)
+}
+
+// toGroup creates the upstream of a group definition from the definitions and upstreams of the other proxies
+func (d ProxyDefinition) toGroup(name string, definitions map[string]ProxyDefinition, upstreams map[string]*proxy.Upstream) (*proxy.Upstream, error) {
+	if d.URL != "" || len(d.Chain) > 0 {
+		return nil, errors.New("url, chain and group are mutually exclusive")
+	}
+	strategy := proxy.GroupStrategy(strings.ToLower(d.Strategy))
+	switch strategy {
+	case "", proxy.Failover, proxy.RoundRobin, proxy.LeastConnections, proxy.ConsistentHash, proxy.Latency:
+	default:
+		return nil, errors.Errorf("unsupported group strategy %q, should be one of %q, %q, %q, %q or %q",
+			d.Strategy, proxy.Failover, proxy.RoundRobin, proxy.LeastConnections, proxy.ConsistentHash, proxy.Latency)
+	}
+	members := make([]*proxy.Upstream, 0, len(d.Group))
+	for _, memberName := range d.Group {
+		if len(definitions[memberName].Group) > 0 {
+			return nil, errors.Errorf("member %q of the group is itself a group", memberName)
+		}
+		member, ok := lookupProxy(upstreams, memberName)
+		if !ok {
+			return nil, errors.Errorf("member %q of the group not found", memberName)
+		}
+		members = append(members, member)
+	}
+	group := proxy.NewGroup(name, members...)
+	group.Group.Strategy = strategy
+	group.Group.CoolDown = d.CoolDown
+	return group, group.Validate()
 }
 
 // Server represents a Sweetcher server configuration file
@@ -14,16 +352,115 @@ type Server struct {
 	Logs    log.LogsConfig `json:"logs,omitempty" mapstructure:"logs"`
 	Address string         `json:"address,omitempty" mapstructure:"address"`
 	Profile string         `json:"profile,omitempty" mapstructure:"profile"`
+	// PACMode defines where the PAC script served on /proxy.pac points clients to:
+	// "self" (default) or "upstream"
+	PACMode string `json:"pac_mode,omitempty" mapstructure:"pac_mode"`
+	// DialTimeout limits the time to connect to sites, directly or through proxies for HTTPS tunnels, no limit by default
+	DialTimeout time.Duration `json:"dial_timeout,omitempty" mapstructure:"dial_timeout"`
+	// TunnelIdleTimeout closes HTTPS and SOCKS tunnels no data went through for that long (ie. "10m"), no limit by default
+	TunnelIdleTimeout time.Duration `json:"tunnel_idle_timeout,omitempty" mapstructure:"tunnel_idle_timeout"`
+	// Socks configures the SOCKS clients served on Address and on an optional additional listener
+	Socks ServerSocks `json:"socks,omitempty" mapstructure:"socks"`
+}
+
+// ServerSocks defines how SOCKS clients are served
+//
+// Address enables an additional SOCKS listener. Clients should authenticate with Username and Password if set,
+// the password may reference a secret.
+type ServerSocks struct {
+	Address  string `json:"address,omitempty" mapstructure:"address"`
+	Username string `json:"username,omitempty" mapstructure:"username"`
+	Password string `json:"password,omitempty" mapstructure:"password"`
+}
+
+// auth returns the credentials of SOCKS clients, nil if they are anonymous
+func (s ServerSocks) auth() (*url.Userinfo, error) {
+	if s.Username == "" {
+		if s.Password != "" {
+			return nil, errors.New("socks password requires a username")
+		}
+		return nil, nil
+	}
+	password, err := resolveSecretRefs(s.Password)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve socks password")
+	}
+	return url.UserPassword(s.Username, password), nil
+}
+
+func (s Server) pacMode() (proxy.PACMode, error) {
+	switch proxy.PACMode(s.PACMode) {
+	case "", proxy.PACModeSelf:
+		return proxy.PACModeSelf, nil
+	case proxy.PACModeUpstream:
+		return proxy.PACModeUpstream, nil
+	default:
+		return "", errors.Errorf("unsupported pac_mode %q, should be either %q or %q", s.PACMode, proxy.PACModeSelf, proxy.PACModeUpstream)
+	}
 }
 
 // Profile represents a Profile definition
+//
+// PAC is a path or an URL to a Proxy Auto-Configuration file used instead of Default
+// when none of the rules match. It is loaded again every PACRefresh, one hour by default,
+// a negative value disables refreshes.
+//
+// RejectMessage is the message sent to clients when their request is refused by a rule
+// or a Default using the reserved "reject" proxy
 type Profile struct {
-	Default string `json:"default,omitempty" mapstructure:"default"`
-	Rules   []Rule `json:"rules,omitempty" mapstructure:"rules"`
+	Default       string        `json:"default,omitempty" mapstructure:"default"`
+	PAC           string        `json:"pac,omitempty" mapstructure:"pac"`
+	PACRefresh    time.Duration `json:"pac_refresh,omitempty" mapstructure:"pac_refresh"`
+	RejectMessage string        `json:"reject_message,omitempty" mapstructure:"reject_message"`
+	Rules         []Rule        `json:"rules,omitempty" mapstructure:"rules"`
 }
 
 // Rule is a routing rule to a proxy
+//
+// Exactly one of the matching criteria (HostWildcard, URLPattern, IPCIDR, HostRegex) should be set
 type Rule struct {
 	HostWildcard string `json:"host_wildcard,omitempty" mapstructure:"host_wildcard"`
-	Proxy        string `json:"proxy,omitempty" mapstructure:"proxy"`
+	URLPattern   string `json:"url_pattern,omitempty" mapstructure:"url_pattern"`
+	IPCIDR       string `json:"ip_cidr,omitempty" mapstructure:"ip_cidr"`
+	HostRegex    string `json:"host_regex,omitempty" mapstructure:"host_regex"`
+	// Resolve allows ip_cidr rules to match hostnames resolving into their range
+	Resolve bool   `json:"resolve,omitempty" mapstructure:"resolve"`
+	Proxy   string `json:"proxy,omitempty" mapstructure:"proxy"`
+}
+
+// String returns the matching criterion of the rule as it was written in the configuration
+func (r Rule) String() string {
+	switch {
+	case r.URLPattern != "":
+		return "url_pattern: " + r.URLPattern
+	case r.IPCIDR != "":
+		return "ip_cidr: " + r.IPCIDR
+	case r.HostRegex != "":
+		return "host_regex: " + r.HostRegex
+	default:
+		return "host_wildcard: " + r.HostWildcard
+	}
+}
+
+func (r Rule) toProxyRule() (proxy.Rule, error) {
+	var rules []proxy.Rule
+	if r.HostWildcard != "" {
+		rules = append(rules, proxy.Rule{Kind: proxy.HostWildcard, Pattern: r.HostWildcard})
+	}
+	if r.URLPattern != "" {
+		rules = append(rules, proxy.Rule{Kind: proxy.URLPattern, Pattern: r.URLPattern})
+	}
+	if r.IPCIDR != "" {
+		rules = append(rules, proxy.Rule{Kind: proxy.IPCIDR, Pattern: r.IPCIDR, Resolve: r.Resolve})
+	}
+	if r.HostRegex != "" {
+		rules = append(rules, proxy.Rule{Kind: proxy.HostRegex, Pattern: r.HostRegex})
+	}
+	if len(rules) != 1 {
+		return proxy.Rule{}, errors.New("a rule should define exactly one of host_wildcard, url_pattern, ip_cidr or host_regex")
+	}
+	if r.Resolve && r.IPCIDR == "" {
+		return proxy.Rule{}, errors.New("resolve is only supported by ip_cidr rules")
+	}
+	return rules[0], rules[0].Validate()
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/loicalbertin/sweetcher/pkg/proxy"
+)
+
+func init() {
+	var profileName string
+	var allProfiles bool
+	matchCmd := &cobra.Command{
+		Use:   "match <url>...",
+		Short: "explains which rule and proxy a profile uses for the given URLs",
+		Long: `Loads the configuration file and prints for each URL which rule of the profile matches and which
+proxy would be used, without starting a server.
+
+As HTTPS requests are proxied using CONNECT requests, https URLs are matched on their host only.
+URLs without a scheme are considered as http URLs.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			conf, err := initConfig()
+			if err != nil {
+				return err
+			}
+			profiles := []string{conf.Server.Profile}
+			if profileName != "" {
+				profiles = []string{profileName}
+			}
+			if allProfiles {
+				profiles = profiles[:0]
+				for name := range conf.Profiles {
+					profiles = append(profiles, name)
+				}
+				sort.Strings(profiles)
+			}
+			return matchURLs(cmd.OutOrStdout(), conf, profiles, args)
+		},
+	}
+	matchCmd.Flags().StringVarP(&profileName, "profile", "p", "", "profile to use instead of the server profile")
+	matchCmd.Flags().BoolVarP(&allProfiles, "all", "a", false, "check URLs against every profile")
+	RootCmd.AddCommand(matchCmd)
+}
+
+func matchURLs(out io.Writer, conf *Config, profiles []string, rawURLs []string) error {
+	proxies, err := parseProxies(conf)
+	if err != nil {
+		return err
+	}
+	proxyNames := make(map[*proxy.Upstream]string, len(proxies))
+	for name, u := range proxies {
+		proxyNames[u] = name
+	}
+
+	reqs := make([]*http.Request, 0, len(rawURLs))
+	for _, rawURL := range rawURLs {
+		req, err := matchRequest(rawURL)
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tPROFILE\tRULE\tMATCHED BY\tPROXY")
+	for _, profileName := range profiles {
+		profile, err := generateNamedProfile(conf, proxies, profileName)
+		if err != nil {
+			return err
+		}
+		for i, req := range reqs {
+			m, err := profile.Match(req)
+			if err != nil {
+				return errors.Wrapf(err, "failed to match %q against profile %q", rawURLs[i], profileName)
+			}
+			position, matchedBy := "-", "default"
+			switch {
+			case m.Rule >= 0:
+				// rules positions are 1-based for humans
+				position = strconv.Itoa(m.Rule + 1)
+				matchedBy = conf.Profiles[profileName].Rules[m.Rule].String()
+			case m.PAC:
+				matchedBy = "pac: " + profile.PAC.Location
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", rawURLs[i], profileName, position, matchedBy, displayProxyName(proxyNames, m.Proxy))
+		}
+	}
+	return tw.Flush()
+}
+
+// matchRequest builds the request Sweetcher would receive for an URL
+func matchRequest(rawURL string) (*http.Request, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid URL %q", rawURL)
+	}
+	if u.Scheme == "https" {
+		host := u.Host
+		if u.Port() == "" {
+			host += ":443"
+		}
+		return &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: host}, Host: host}, nil
+	}
+	return &http.Request{Method: http.MethodGet, URL: u, Host: u.Host}, nil
+}
+
+// displayProxyName returns the configuration name of a proxy
+func displayProxyName(proxyNames map[*proxy.Upstream]string, p *proxy.Upstream) string {
+	switch p {
+	case nil:
+		return "direct"
+	case proxy.Reject:
+		return "reject"
+	}
+	if name, ok := proxyNames[p]; ok {
+		return name
+	}
+	// proxies chosen by PAC scripts are not named
+	return p.URL.Redacted()
+}
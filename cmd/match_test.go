@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_matchURLs(t *testing.T) {
+	conf := &Config{
+		Server: Server{Profile: "atCompany"},
+		Proxies: map[string]ProxyDefinition{
+			"main":   {URL: "http://masterproxy.yourcompany.it:8080"},
+			"hidden": {URL: "http://hiddenproxy.yourcompany.it"},
+		},
+		Profiles: map[string]Profile{
+			"atCompany": {Default: "main", Rules: []Rule{
+				{HostWildcard: "gist.github.com", Proxy: "hidden"},
+				{URLPattern: "http://repo.yourcompany.it/private/*", Proxy: "hidden"},
+				{HostWildcard: "*.yourcompany.it", Proxy: "direct"},
+				{HostWildcard: "telemetry.*", Proxy: "reject"},
+			}},
+			"homeworking": {Default: "direct"},
+		},
+	}
+	var sb strings.Builder
+	err := matchURLs(&sb, conf, []string{"atCompany", "homeworking"}, []string{
+		"https://gist.github.com/loicalbertin",
+		"http://repo.yourcompany.it/private/lib.jar",
+		"https://repo.yourcompany.it/private/lib.jar",
+		"telemetry.example.com",
+		"http://www.google.com",
+	})
+	assert.NilError(t, err)
+	lines := strings.Split(strings.TrimSpace(sb.String()), "\n")
+	assert.Equal(t, len(lines), 11)
+	expected := [][]string{
+		{"URL", "PROFILE", "RULE", "MATCHED", "BY", "PROXY"},
+		{"https://gist.github.com/loicalbertin", "atCompany", "1", "host_wildcard:", "gist.github.com", "hidden"},
+		{"http://repo.yourcompany.it/private/lib.jar", "atCompany", "2", "url_pattern:", "http://repo.yourcompany.it/private/*", "hidden"},
+		{"https://repo.yourcompany.it/private/lib.jar", "atCompany", "2", "url_pattern:", "http://repo.yourcompany.it/private/*", "hidden"},
+		{"telemetry.example.com", "atCompany", "4", "host_wildcard:", "telemetry.*", "reject"},
+		{"http://www.google.com", "atCompany", "-", "default", "main"},
+		{"https://gist.github.com/loicalbertin", "homeworking", "-", "default", "direct"},
+	}
+	for i, want := range expected {
+		assert.DeepEqual(t, strings.Fields(lines[i]), want)
+	}
+
+	err = matchURLs(&sb, conf, []string{"unknown"}, []string{"http://www.google.com"})
+	assert.ErrorContains(t, err, `"unknown" not found`)
+	err = matchURLs(&sb, conf, []string{"atCompany"}, []string{"http://[::1"})
+	assert.ErrorContains(t, err, "invalid URL")
+}
@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// secretRef matches references to secrets in the credentials of proxy definitions:
+//
+//   - ${env:NAME} is replaced by the value of the NAME environment variable
+//   - ${file:path} is replaced by the content of a file
+//   - ${cmd:command} is replaced by the output of a shell command (ie. "pass show corp/proxy")
+//
+// Trailing newlines of files contents and commands outputs are removed.
+var secretRef = regexp.MustCompile(`\$\{(env|file|cmd):([^}]*)\}`)
+
+// secretCommandTimeout is the maximum duration of a ${cmd:...} secret command
+const secretCommandTimeout = 30 * time.Second
+
+// redactedSecret replaces plaintext passwords when printing the configuration
+const redactedSecret = "xxxxx"
+
+// maskSecretRefs replaces secret references by placeholders that are valid in any part of an URL
+func maskSecretRefs(s string) (string, []string) {
+	var refs []string
+	masked := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		refs = append(refs, ref)
+		return secretPlaceholder(len(refs) - 1)
+	})
+	return masked, refs
+}
+
+func secretPlaceholder(i int) string {
+	return fmt.Sprintf("sweetcher-secret-%d-", i)
+}
+
+// unmaskSecretRefs replaces the placeholders of s using the given function
+func unmaskSecretRefs(s string, refs []string, replace func(ref string) (string, error)) (string, error) {
+	for i, ref := range refs {
+		placeholder := secretPlaceholder(i)
+		if !strings.Contains(s, placeholder) {
+			continue
+		}
+		value, err := replace(ref)
+		if err != nil {
+			return "", err
+		}
+		s = strings.ReplaceAll(s, placeholder, value)
+	}
+	return s, nil
+}
+
+// parseProxyURL parses a proxy URL resolving the secret references of its credentials
+//
+// Errors never contain the URL itself as it may hold plaintext credentials.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	masked, refs := maskSecretRefs(rawURL)
+	u, err := url.Parse(masked)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, errors.Wrap(err, "invalid URL")
+	}
+	if u.User != nil {
+		user, err := unmaskSecretRefs(u.User.Username(), refs, resolveSecret)
+		if err != nil {
+			return nil, err
+		}
+		if password, ok := u.User.Password(); ok {
+			password, err = unmaskSecretRefs(password, refs, resolveSecret)
+			if err != nil {
+				return nil, err
+			}
+			u.User = url.UserPassword(user, password)
+		} else {
+			u.User = url.User(user)
+		}
+	}
+	withoutUser := *u
+	withoutUser.User = nil
+	if len(refs) > 0 && strings.Contains(withoutUser.String(), "sweetcher-secret-") {
+		return nil, errors.New("secret references are only supported in credentials")
+	}
+	return u, nil
+}
+
+// resolveSecret returns the value of a secret reference
+func resolveSecret(ref string) (string, error) {
+	m := secretRef.FindStringSubmatch(ref)
+	kind, arg := m[1], m[2]
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", errors.Errorf("environment variable %q referenced by %s is not set", arg, ref)
+		}
+		return value, nil
+	case "file":
+		info, err := os.Stat(arg)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read secret file referenced by %s", ref)
+		}
+		if runtime.GOOS != "windows" && info.Mode().Perm()&0o077 != 0 {
+			slog.Warn("Secret file is accessible by other users, consider restricting its permissions", "file", arg, "mode", info.Mode().Perm().String())
+		}
+		b, err := os.ReadFile(arg)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read secret file referenced by %s", ref)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.CommandContext(ctx, "cmd", "/C", arg)
+		} else {
+			cmd = exec.CommandContext(ctx, "sh", "-c", arg)
+		}
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", errors.Wrapf(err, "secret command referenced by %s failed", ref)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+}
+
+// resolveSecretRefs replaces the secret references of s by their values
+func resolveSecretRefs(s string) (string, error) {
+	masked, refs := maskSecretRefs(s)
+	return unmaskSecretRefs(masked, refs, resolveSecret)
+}
+
+// isSecretRef returns true if s is a single secret reference
+func isSecretRef(s string) bool {
+	loc := secretRef.FindStringIndex(s)
+	return loc != nil && loc[0] == 0 && loc[1] == len(s)
+}
+
+// redactProxyURL hides the plaintext password of a proxy URL,
+// secret references are kept as they do not disclose secrets
+func redactProxyURL(rawURL string) string {
+	masked, refs := maskSecretRefs(rawURL)
+	u, err := url.Parse(masked)
+	if err != nil {
+		// malformed URLs may hold credentials anywhere
+		return redactedSecret
+	}
+	if password, ok := u.User.Password(); ok {
+		if !isSecretPlaceholder(password, refs) {
+			u.User = url.UserPassword(u.User.Username(), redactedSecret)
+		}
+	}
+	redacted, _ := unmaskSecretRefs(u.String(), refs, func(ref string) (string, error) { return ref, nil })
+	return redacted
+}
+
+func isSecretPlaceholder(s string, refs []string) bool {
+	for i := range refs {
+		if s == secretPlaceholder(i) {
+			return true
+		}
+	}
+	return false
+}
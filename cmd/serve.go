@@ -3,7 +3,6 @@ package cmd
 import (
 	"context"
 	"log/slog"
-	"net/url"
 	"os"
 
 	"github.com/fsnotify/fsnotify"
@@ -31,7 +30,22 @@ func init() {
 			if err != nil {
 				return err
 			}
-			server = &proxy.Server{Addr: conf.Server.Address}
+			pacMode, err := conf.Server.pacMode()
+			if err != nil {
+				return err
+			}
+			socksAuth, err := conf.Server.Socks.auth()
+			if err != nil {
+				return err
+			}
+			server = &proxy.Server{
+				Addr:              conf.Server.Address,
+				PACMode:           pacMode,
+				DialTimeout:       conf.Server.DialTimeout,
+				TunnelIdleTimeout: conf.Server.TunnelIdleTimeout,
+				SocksAddr:         conf.Server.Socks.Address,
+				SocksAuth:         socksAuth,
+			}
 			server.SetupProfile(profile)
 
 			viper.WatchConfig()
@@ -50,8 +64,7 @@ func updateConfigOnChangeEvent(e fsnotify.Event) {
 
 	logger := slog.With(slog.String("file", e.Name))
 	logger.Info("reloading config file")
-	c := &Config{}
-	err := viper.Unmarshal(c)
+	c, err := unmarshalConfig(viper.GetViper())
 	if err != nil {
 		logger.Error("Failed to read config file", "error", err)
 		return
@@ -67,6 +80,21 @@ func updateConfigOnChangeEvent(e fsnotify.Event) {
 		logger.Error("Failed to create profile from config file", "error", err)
 		return
 	}
+	pacMode, err := c.Server.pacMode()
+	if err != nil {
+		logger.Error("Failed to read config file", "error", err)
+		return
+	}
+	socksAuth, err := c.Server.Socks.auth()
+	if err != nil {
+		logger.Error("Failed to read config file", "error", err)
+		return
+	}
+	server.PACMode = pacMode
+	server.DialTimeout = c.Server.DialTimeout
+	server.TunnelIdleTimeout = c.Server.TunnelIdleTimeout
+	// the SOCKS listener address is only read at startup
+	server.SocksAuth = socksAuth
 	server.SetupProfile(profile)
 	logger.Info("Profile reloaded")
 }
@@ -80,8 +108,10 @@ func initConfig() (*Config, error) {
 	if err != nil {                         // Handle errors reading the config file
 		return nil, errors.Errorf("Fatal error config file: %s", err)
 	}
-	conf := &Config{}
-	viper.Unmarshal(conf)
+	conf, err := unmarshalConfig(viper.GetViper())
+	if err != nil {
+		return nil, errors.Wrap(err, "Fatal error config file")
+	}
 	err = log.SetupLogs(conf.Server.Logs)
 	if err != nil {
 		os.Exit(1)
@@ -90,34 +120,111 @@ func initConfig() (*Config, error) {
 }
 
 func generateProfile(cfg *Config) (*proxy.Profile, error) {
-	proxies := make(map[string]*url.URL)
-	for proxyName, proxyURL := range cfg.Proxies {
-		p, err := url.Parse(proxyURL)
+	proxies, err := parseProxies(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return generateNamedProfile(cfg, proxies, cfg.Server.Profile)
+}
+
+func parseProxies(cfg *Config) (map[string]*proxy.Upstream, error) {
+	proxies := make(map[string]*proxy.Upstream)
+	for proxyName, definition := range cfg.Proxies {
+		if len(definition.Chain) > 0 || len(definition.Group) > 0 {
+			continue
+		}
+		p, err := definition.toUpstream()
 		if err != nil {
 			return nil, errors.Wrapf(err, "Malformed proxy definition for proxy %q", proxyName)
 		}
 		proxies[proxyName] = p
 	}
+	// chains and then groups are built once the proxies they reference are known
+	for proxyName, definition := range cfg.Proxies {
+		if len(definition.Chain) == 0 {
+			continue
+		}
+		p, err := definition.toChain(cfg.Proxies, proxies)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Malformed proxy definition for proxy %q", proxyName)
+		}
+		proxies[proxyName] = p
+	}
+	for proxyName, definition := range cfg.Proxies {
+		if len(definition.Group) == 0 {
+			continue
+		}
+		p, err := definition.toGroup(proxyName, cfg.Proxies, proxies)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Malformed proxy definition for proxy %q", proxyName)
+		}
+		proxies[proxyName] = p
+	}
+	return proxies, nil
+}
+
+func generateNamedProfile(cfg *Config, proxies map[string]*proxy.Upstream, profileName string) (*proxy.Profile, error) {
 	// Defaults to direct proxy
-	profile := &proxy.Profile{}
-	if cfg.Server.Profile == "direct" {
-		return profile, nil
+	if profileName == "direct" {
+		return proxy.NewProfile(nil, nil)
 	}
-	p, ok := cfg.Profiles[cfg.Server.Profile]
+	p, ok := cfg.Profiles[profileName]
 	if !ok {
-		return nil, errors.Errorf("specified server profile %q not found", cfg.Server.Profile)
+		return nil, errors.Errorf("specified server profile %q not found", profileName)
 	}
-	def, ok := proxies[p.Default]
-	if !ok && p.Default != "direct" {
-		return nil, errors.Errorf("specified default proxy %q not found for profile %q", p.Default, cfg.Server.Profile)
+	var def *proxy.Upstream
+	var pac *proxy.PAC
+	if p.PAC != "" {
+		if p.Default != "" {
+			return nil, errors.Errorf("default proxy and pac file are mutually exclusive in profile %q", profileName)
+		}
+		var err error
+		pac, err = proxy.LoadPAC(context.Background(), p.PAC)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pac file for profile %q", profileName)
+		}
+		if p.PACRefresh != 0 {
+			pac.RefreshInterval = p.PACRefresh
+		}
+	} else {
+		def, ok = lookupProxy(proxies, p.Default)
+		if !ok {
+			return nil, errors.Errorf("specified default proxy %q not found for profile %q", p.Default, profileName)
+		}
 	}
-	profile.Default = def
+	rules := make([]proxy.Rule, 0, len(p.Rules))
 	for _, r := range p.Rules {
-		rp, ok := proxies[r.Proxy]
-		if !ok && r.Proxy != "direct" {
-			return nil, errors.Errorf("specified proxy %q not found for rule %q in profile %q", r.Proxy, r.HostWildcard, cfg.Server.Profile)
+		rule, err := r.toProxyRule()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule %q in profile %q", r, profileName)
+		}
+		rp, ok := lookupProxy(proxies, r.Proxy)
+		if !ok {
+			return nil, errors.Errorf("specified proxy %q not found for rule %q in profile %q", r.Proxy, r, profileName)
 		}
-		profile.Rules = append(profile.Rules, proxy.Rule{Pattern: r.HostWildcard, Proxy: rp})
+		rule.Proxy = rp
+		rules = append(rules, rule)
 	}
+	profile, err := proxy.NewProfile(def, rules)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compile rules of profile %q", profileName)
+	}
+	profile.PAC = pac
+	profile.RejectMessage = p.RejectMessage
 	return profile, nil
 }
+
+// lookupProxy returns the upstream proxy referenced by a profile, handling the reserved
+// words "direct" (nil) and "reject" or "block" (proxy.Reject)
+func lookupProxy(proxies map[string]*proxy.Upstream, name string) (*proxy.Upstream, bool) {
+	if p, ok := proxies[name]; ok {
+		return p, true
+	}
+	switch name {
+	case "direct":
+		return nil, true
+	case "reject", "block":
+		return proxy.Reject, true
+	}
+	return nil, false
+}
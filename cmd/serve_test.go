@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_generateProfile(t *testing.T) {
+	proxies := map[string]ProxyDefinition{
+		"main":      {URL: "http://masterproxy.yourcompany.it:8080"},
+		"hidden":    {URL: "http://hiddenproxy.yourcompany.it"},
+		"socks":     {URL: "socks5h://socks.lab.yourcompany.it"},
+		"lab":       {Chain: []string{"hidden", "socks"}},
+		"corporate": {Group: []string{"main", "lab", "direct"}},
+	}
+	tests := []struct {
+		name    string
+		profile Profile
+		wantErr string
+	}{
+		{"ValidProfile", Profile{Default: "main", Rules: []Rule{
+			{HostWildcard: "*.yourcompany.it", Proxy: "direct"},
+			{URLPattern: "http://repo.yourcompany.it/private/*", Proxy: "hidden"},
+			{IPCIDR: "10.12.0.0/16", Proxy: "direct"},
+			{IPCIDR: "10.13.0.0/16", Resolve: true, Proxy: "direct"},
+			{HostRegex: `^(build|ci)[0-9]+\.yourcompany\.it$`, Proxy: "hidden"},
+			{HostWildcard: "telemetry.*", Proxy: "reject"},
+			{HostWildcard: "metrics.*", Proxy: "block"},
+		}}, ""},
+		{"ChainDefault", Profile{Default: "lab", Rules: []Rule{{HostWildcard: "*.yourcompany.it", Proxy: "hidden"}}}, ""},
+		{"GroupDefault", Profile{Default: "corporate", Rules: []Rule{{HostWildcard: "*.yourcompany.it", Proxy: "lab"}}}, ""},
+		{"RejectDefault", Profile{Default: "reject", RejectMessage: "blocked"}, ""},
+		{"UnknownDefault", Profile{Default: "unknown"},
+			`specified default proxy "unknown" not found for profile "test"`},
+		{"UnknownRuleProxy", Profile{Default: "main", Rules: []Rule{{HostWildcard: "*.google.com", Proxy: "unknown"}}},
+			`specified proxy "unknown" not found for rule "host_wildcard: *.google.com" in profile "test"`},
+		{"NoCriterion", Profile{Default: "main", Rules: []Rule{{Proxy: "hidden"}}},
+			`invalid rule "host_wildcard: " in profile "test": a rule should define exactly one of`},
+		{"SeveralCriteria", Profile{Default: "main", Rules: []Rule{{HostWildcard: "*.google.com", IPCIDR: "10.0.0.0/8", Proxy: "hidden"}}},
+			`a rule should define exactly one of`},
+		{"ResolveWithoutCIDR", Profile{Default: "main", Rules: []Rule{{HostWildcard: "*.google.com", Resolve: true, Proxy: "hidden"}}},
+			`invalid rule "host_wildcard: *.google.com" in profile "test": resolve is only supported by ip_cidr rules`},
+		{"InvalidRegex", Profile{Default: "main", Rules: []Rule{{HostRegex: `^(build|ci`, Proxy: "hidden"}}},
+			`invalid rule "host_regex: ^(build|ci" in profile "test": invalid regular expression`},
+		{"InvalidCIDR", Profile{Default: "main", Rules: []Rule{{IPCIDR: "10.12.0.0/33", Proxy: "hidden"}}},
+			`invalid rule "ip_cidr: 10.12.0.0/33" in profile "test": invalid CIDR block`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Server:   Server{Profile: "test"},
+				Proxies:  proxies,
+				Profiles: map[string]Profile{"test": tt.profile},
+			}
+			p, err := generateProfile(cfg)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, len(p.Rules), len(tt.profile.Rules))
+		})
+	}
+}
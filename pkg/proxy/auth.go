@@ -0,0 +1,558 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+// Authentication schemes supported for upstream proxies, ordered by preference
+const (
+	authNTLM   = "ntlm"
+	authDigest = "digest"
+	authBasic  = "basic"
+)
+
+// A challenge is an authentication challenge sent by an upstream proxy in a Proxy-Authenticate header
+type challenge struct {
+	// scheme is the lower-cased authentication scheme
+	scheme string
+	// token is the base64 token of connection-oriented schemes like NTLM
+	token string
+	// params are the auth-params of schemes like Digest
+	params map[string]string
+}
+
+// parseChallenges parses the Proxy-Authenticate headers of a response, one challenge per header
+func parseChallenges(h http.Header) []challenge {
+	var challenges []challenge
+	for _, v := range h.Values("Proxy-Authenticate") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		scheme, rest, _ := strings.Cut(v, " ")
+		c := challenge{scheme: strings.ToLower(scheme)}
+		rest = strings.TrimSpace(rest)
+		if c.scheme == authNTLM {
+			c.token = rest
+		} else {
+			c.params = parseAuthParams(rest)
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges
+}
+
+// parseAuthParams parses a comma separated list of key=value auth-params where values may be quoted strings
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		var key string
+		key, s, _ = strings.Cut(s, "=")
+		key = strings.ToLower(strings.TrimSpace(strings.TrimLeft(key, ", ")))
+		s = strings.TrimLeft(s, " ")
+		var value strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			s = s[min(i+1, len(s)):]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		_, s, _ = strings.Cut(s, ",")
+		if key != "" {
+			params[key] = value.String()
+		}
+	}
+	return params
+}
+
+// pickChallenge returns the strongest supported challenge: NTLM, then Digest, then Basic
+func pickChallenge(challenges []challenge) (challenge, bool) {
+	for _, scheme := range []string{authNTLM, authDigest, authBasic} {
+		for _, c := range challenges {
+			if c.scheme == scheme {
+				return c, true
+			}
+		}
+	}
+	return challenge{}, false
+}
+
+// An authSender sends a request to the proxy with the given Proxy-Authorization value, which may be empty.
+// expectChallenge is set when the proxy is expected to answer with a 407 challenge rather than to forward the request.
+type authSender func(auth string, expectChallenge bool) (*http.Response, error)
+
+// authHandshake performs the challenge-response authentication of the given NTLM or Digest challenge.
+//
+// send sends the request again with the given Proxy-Authorization value, it is called once for Digest
+// and twice for NTLM which should use the same connection for both calls.
+func authHandshake(proxy *url.URL, c challenge, method, uri string, send authSender) (*http.Response, error) {
+	password, _ := proxy.User.Password()
+	slog.Debug("Authenticating against upstream proxy", "proxy", proxy.Redacted(), "scheme", c.scheme)
+	switch c.scheme {
+	case authNTLM:
+		user, domain, domainNeeded := ntlmssp.GetDomain(proxy.User.Username())
+		negotiate, err := ntlmssp.NewNegotiateMessage(domain, "")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := send("NTLM "+base64.StdEncoding.EncodeToString(negotiate), true)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+			return resp, err
+		}
+		var token []byte
+		for _, rc := range parseChallenges(resp.Header) {
+			if rc.scheme == authNTLM && rc.token != "" {
+				token, err = base64.StdEncoding.DecodeString(rc.token)
+				break
+			}
+		}
+		if token == nil || err != nil {
+			// the proxy refused the negotiation, let the caller report the 407
+			return resp, nil
+		}
+		authenticate, err := ntlmssp.ProcessChallenge(token, user, password, domainNeeded)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("invalid NTLM challenge from upstream proxy %s: %w", proxy.Redacted(), err)
+		}
+		return send("NTLM "+base64.StdEncoding.EncodeToString(authenticate), false)
+	case authDigest:
+		auth, err := digestAuthorization(c.params, proxy.User.Username(), password, method, uri)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported Digest challenge from upstream proxy %s: %w", proxy.Redacted(), err)
+		}
+		return send(auth, false)
+	}
+	return nil, fmt.Errorf("unsupported authentication scheme %q for upstream proxy %s", c.scheme, proxy.Redacted())
+}
+
+// newCnonce generates Digest client nonces, tests may replace it to get predictable responses
+var newCnonce = func() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// digestAuthorization computes a Digest Proxy-Authorization header as described by RFC 7616
+func digestAuthorization(params map[string]string, user, password, method, uri string) (string, error) {
+	algorithm := params["algorithm"]
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	var newHash func() hash.Hash
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	h := func(parts ...string) string {
+		d := newHash()
+		io.WriteString(d, strings.Join(parts, ":"))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	var qop string
+	if params["qop"] != "" {
+		for _, q := range strings.Split(params["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported qop %q", params["qop"])
+		}
+	}
+	realm, nonce := params["realm"], params["nonce"]
+	cnonce, nc := newCnonce(), "00000001"
+	ha1 := h(user, realm, password)
+	if strings.HasSuffix(strings.ToUpper(algorithm), "-SESS") {
+		ha1 = h(ha1, nonce, cnonce)
+	}
+	ha2 := h(method, uri)
+	var response string
+	if qop != "" {
+		response = h(ha1, nonce, nc, cnonce, qop, ha2)
+	} else {
+		response = h(ha1, nonce, ha2)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, response=%q", user, realm, nonce, uri, algorithm, response)
+	if opaque, ok := params["opaque"]; ok {
+		fmt.Fprintf(&sb, ", opaque=%q", opaque)
+	}
+	if qop != "" {
+		fmt.Fprintf(&sb, ", qop=%s, nc=%s, cnonce=%q", qop, nc, cnonce)
+	}
+	return sb.String(), nil
+}
+
+// authenticationScheme returns the scheme forced by the upstream definition or learned from the proxy challenges
+func (u *Upstream) authenticationScheme() string {
+	if u.Auth != "" {
+		return u.Auth
+	}
+	scheme, _ := u.authScheme.Load().(string)
+	return scheme
+}
+
+// authenticate sends a request to the proxy using send, authenticating with the upstream credentials
+// if the proxy requires it.
+//
+// Credentials are only sent once the proxy asked for them, using Basic only if it is offered,
+// unless the scheme is set by the upstream definition or was learned from previous challenges.
+func (u *Upstream) authenticate(method, uri string, send authSender) (*http.Response, error) {
+	if u.URL.User == nil {
+		return send("", false)
+	}
+	switch u.authenticationScheme() {
+	case authNTLM:
+		// no need for a challenge to start an NTLM handshake
+		return authHandshake(u.URL, challenge{scheme: authNTLM}, method, uri, send)
+	case authBasic:
+		auth, _ := proxyAuthorization(u.URL)
+		return send(auth, false)
+	}
+	resp, err := send("", true)
+	if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+		return resp, err
+	}
+	challenges := parseChallenges(resp.Header)
+	if u.Auth != "" {
+		challenges = filterChallenges(challenges, u.Auth)
+	}
+	c, ok := pickChallenge(challenges)
+	if !ok {
+		return resp, nil
+	}
+	if u.Auth == "" {
+		u.authScheme.Store(c.scheme)
+	}
+	if c.scheme == authBasic {
+		auth, _ := proxyAuthorization(u.URL)
+		return send(auth, false)
+	}
+	return authHandshake(u.URL, c, method, uri, send)
+}
+
+func filterChallenges(challenges []challenge, scheme string) []challenge {
+	var filtered []challenge
+	for _, c := range challenges {
+		if c.scheme == scheme {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// A proxyConn is a connection to an upstream HTTP proxy used to send requests and
+// authenticate on the same connection
+type proxyConn struct {
+	// ctx interrupts the dial of the proxy and the requests sent
+	ctx      context.Context
+	upstream *Upstream
+	network  string
+	conn     net.Conn
+	br       *bufio.Reader
+	// last is the last response read on the connection
+	last *http.Response
+	// tunnel is set for CONNECT requests which may use warm connections
+	tunnel bool
+	// warm is set while the connection was established ahead and not used yet
+	warm bool
+}
+
+// send writes a request to the proxy and reads its response.
+//
+// The body of the previous response is discarded first and the proxy is dialed again if it
+// closed the connection.
+func (pc *proxyConn) send(req *http.Request, asProxyRequest bool) (*http.Response, error) {
+	if pc.last != nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(pc.last.Body, 1<<20))
+		pc.last.Body.Close()
+		if pc.last.Close {
+			pc.Close()
+		}
+		pc.last = nil
+	}
+	if pc.conn == nil {
+		if err := pc.connect(); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := pc.exchange(req, asProxyRequest)
+	if err != nil && pc.warm && pc.ctx.Err() == nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		// the proxy may have closed the warm connection while it was idle
+		if err := pc.connect(); err != nil {
+			return nil, err
+		}
+		resp, err = pc.exchange(req, asProxyRequest)
+	}
+	pc.warm = false
+	if err != nil {
+		return nil, err
+	}
+	pc.last = resp
+	return resp, nil
+}
+
+// connect opens the connection to the proxy, tunnels use warm connections if available
+func (pc *proxyConn) connect() error {
+	if pc.tunnel && !pc.warm {
+		if c := pc.upstream.takeWarmConn(); c != nil {
+			pc.conn, pc.br, pc.warm = c, bufio.NewReader(c), true
+			return nil
+		}
+	}
+	pc.warm = false
+	c, err := pc.upstream.dialProxy(pc.ctx, pc.network)
+	if err != nil {
+		return err
+	}
+	pc.conn, pc.br = c, bufio.NewReader(c)
+	return nil
+}
+
+// exchange writes the request and reads its response headers within the upstream ResponseTimeout,
+// closing the connection on errors
+func (pc *proxyConn) exchange(req *http.Request, asProxyRequest bool) (*http.Response, error) {
+	conn := pc.conn
+	stop := context.AfterFunc(pc.ctx, func() { _ = conn.SetDeadline(aLongTimeAgo) })
+	resp, err := pc.writeAndRead(req, asProxyRequest)
+	if !stop() || errors.Is(err, os.ErrDeadlineExceeded) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		pc.Close()
+		step := "request to"
+		if req.Method == http.MethodConnect {
+			step = "CONNECT request to"
+		}
+		return nil, pc.upstream.timeoutError(pc.ctx, step, pc.upstream.ResponseTimeout)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return resp, nil
+}
+
+func (pc *proxyConn) writeAndRead(req *http.Request, asProxyRequest bool) (*http.Response, error) {
+	// both report the headers written to the httptrace.ClientTrace of the request context, which groups rely on
+	// to not replay plain requests already sent to a member
+	write := req.Write
+	if asProxyRequest {
+		write = req.WriteProxy
+	}
+	if err := write(pc.conn); err != nil {
+		return nil, err
+	}
+	if timeout := pc.upstream.ResponseTimeout; timeout > 0 {
+		_ = pc.conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	return http.ReadResponse(pc.br, req)
+}
+
+// aLongTimeAgo is a deadline in the past interrupting pending reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Close closes the connection to the proxy, it will be dialed again on the next send
+func (pc *proxyConn) Close() error {
+	if pc.conn == nil {
+		return nil
+	}
+	err := pc.conn.Close()
+	pc.conn, pc.br = nil, nil
+	return err
+}
+
+// roundTrip forwards a plain request to the proxy, authenticating if required.
+//
+// Requests to proxies requiring NTLM or Digest authentication are sent on a dedicated connection,
+// their body is buffered up to maxBufferedBody so it can be sent again during the handshake.
+// Until the authentication scheme is learned, requests are sent without credentials: larger bodies
+// are then sent once and the request fails if the proxy asks for credentials.
+func (u *Upstream) roundTrip(r *http.Request) (*http.Response, error) {
+	if u.URL.User == nil || isSocks(u.URL.Scheme) || u.URL.Scheme == "ssh" {
+		return u.getTransport().RoundTrip(r)
+	}
+	scheme := u.authenticationScheme()
+	if scheme == authBasic {
+		if r.URL.Scheme == "http" {
+			// https targets are tunneled, the transport authenticates its CONNECT requests
+			auth, _ := proxyAuthorization(u.URL)
+			r = r.Clone(r.Context())
+			r.Header.Set("Proxy-Authorization", auth)
+		}
+		return u.getTransport().RoundTrip(r)
+	}
+	body, buffered, err := bufferBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "" {
+		// the proxy may not require authentication, the transport sends no credentials
+		resp, err := u.getTransport().RoundTrip(r)
+		if err != nil || resp.StatusCode != http.StatusProxyAuthRequired {
+			return resp, err
+		}
+		c, ok := pickChallenge(parseChallenges(resp.Header))
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		u.authScheme.Store(c.scheme)
+		if !buffered {
+			return nil, fmt.Errorf("proxy %s requires %s authentication and the request body larger than %d bytes can't be sent again, retry the request",
+				u.URL.Redacted(), c.scheme, maxBufferedBody)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if c.scheme == authBasic {
+			return u.roundTrip(r)
+		}
+	}
+	return u.roundTripAuth(r, body, buffered)
+}
+
+// roundTripAuth sends a request on a dedicated connection to the proxy performing the authentication handshake.
+//
+// A body which is not buffered can only be sent once: the requests expected to be challenged are then
+// replaced by body-less OPTIONS requests. As the authentication scheme is known by then, the proxy answers
+// them with a challenge, they only reach the target if the proxy unexpectedly lets them through.
+func (u *Upstream) roundTripAuth(r *http.Request, body []byte, buffered bool) (*http.Response, error) {
+	release, err := u.acquireConn(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	pc := &proxyConn{ctx: r.Context(), upstream: u, network: "tcp"}
+	done := closerFunc(func() {
+		pc.Close()
+		if release != nil {
+			release()
+		}
+	})
+	var probed bool
+	send := func(auth string, expectChallenge bool) (*http.Response, error) {
+		req := r.Clone(r.Context())
+		probed = !buffered && expectChallenge
+		switch {
+		case probed:
+			req.Method = http.MethodOptions
+			req.Body, req.ContentLength, req.TransferEncoding = nil, 0, nil
+		case buffered:
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		return pc.send(req, true)
+	}
+	resp, err := u.authenticate(r.Method, proxyRequestURI(r), send)
+	if err == nil && probed && resp.StatusCode != http.StatusProxyAuthRequired {
+		// the proxy let the probe through, the request itself is still to be sent
+		resp, err = send("", false)
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return closeWithBody(resp, done), nil
+}
+
+// proxyRequestURI returns the request target written by Request.WriteProxy, which Digest responses cover
+func proxyRequestURI(r *http.Request) string {
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	return r.URL.Scheme + "://" + host + r.URL.RequestURI()
+}
+
+// maxBufferedBody is the size of the largest request bodies buffered to be sent several times,
+// tests may lower it
+var maxBufferedBody int64 = 4 << 20
+
+// bufferBody reads the body of r so that it can be sent several times. It returns false if the body is
+// larger than maxBufferedBody, r.Body is then kept readable from its start to be sent once.
+func bufferBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBufferedBody+1))
+	if err != nil {
+		r.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(body)) > maxBufferedBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+// closeWithBody makes the response close the proxy connection once its body is closed
+func closeWithBody(resp *http.Response, c io.Closer) *http.Response {
+	resp.Body = &closingBody{ReadCloser: resp.Body, c: c}
+	return resp
+}
+
+type closingBody struct {
+	io.ReadCloser
+	c io.Closer
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.c.Close()
+	return err
+}
+
+// bufferedConn is a net.Conn reading through the buffered reader used to read the CONNECT response
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_parseChallenges(t *testing.T) {
+	h := make(http.Header)
+	h.Add("Proxy-Authenticate", `Basic realm="corp"`)
+	h.Add("Proxy-Authenticate", `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+	h.Add("Proxy-Authenticate", "NTLM TlRMTVNTUAACAAAA")
+
+	challenges := parseChallenges(h)
+	assert.Equal(t, len(challenges), 3)
+	assert.Equal(t, challenges[0].scheme, "basic")
+	assert.DeepEqual(t, challenges[0].params, map[string]string{"realm": "corp"})
+	assert.Equal(t, challenges[1].scheme, "digest")
+	assert.DeepEqual(t, challenges[1].params, map[string]string{
+		"realm":     "http-auth@example.org",
+		"qop":       "auth, auth-int",
+		"algorithm": "SHA-256",
+		"nonce":     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+		"opaque":    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+	})
+	assert.Equal(t, challenges[2].scheme, "ntlm")
+	assert.Equal(t, challenges[2].token, "TlRMTVNTUAACAAAA")
+
+	c, ok := pickChallenge(challenges)
+	assert.Assert(t, ok)
+	assert.Equal(t, c.scheme, "ntlm")
+	c, ok = pickChallenge(challenges[:2])
+	assert.Assert(t, ok)
+	assert.Equal(t, c.scheme, "digest")
+	_, ok = pickChallenge(nil)
+	assert.Assert(t, !ok)
+}
+
+func Test_parseAuthParams(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want map[string]string
+	}{
+		{"Empty", "", map[string]string{}},
+		{"Token", "algorithm=MD5", map[string]string{"algorithm": "MD5"}},
+		{"Quoted", `realm="a, b", stale=false`, map[string]string{"realm": "a, b", "stale": "false"}},
+		{"Escaped", `realm="say \"hi\""`, map[string]string{"realm": `say "hi"`}},
+		{"CaseAndSpaces", ` Realm = "x" ,NONCE=y`, map[string]string{"realm": "x", "nonce": "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.DeepEqual(t, parseAuthParams(tt.s), tt.want)
+		})
+	}
+}
+
+func Test_digestAuthorization(t *testing.T) {
+	// examples from RFC 2617 and RFC 7616
+	tests := []struct {
+		name         string
+		params       map[string]string
+		user, pass   string
+		cnonce       string
+		wantResponse string
+		wantErr      bool
+	}{
+		{"RFC2617", map[string]string{"realm": "testrealm@host.com", "qop": "auth,auth-int", "nonce": "dcd98b7102dd2f0e8b11d0f600bfb0c093", "opaque": "5ccc069c403ebaf9f0171e9517f40e41"},
+			"Mufasa", "Circle Of Life", "0a4f113b", `response="6629fae49393a05397450978507c4ef1"`, false},
+		{"RFC7616MD5", map[string]string{"realm": "http-auth@example.org", "qop": "auth, auth-int", "algorithm": "MD5", "nonce": "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", "opaque": "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"},
+			"Mufasa", "Circle of Life", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", `response="8ca523f5e9506fed4657c9700eebdbec"`, false},
+		{"RFC7616SHA256", map[string]string{"realm": "http-auth@example.org", "qop": "auth, auth-int", "algorithm": "SHA-256", "nonce": "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", "opaque": "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"},
+			"Mufasa", "Circle of Life", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", `response="753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"`, false},
+		{"UnsupportedAlgorithm", map[string]string{"realm": "r", "nonce": "n", "algorithm": "SHA-512-256"}, "u", "p", "c", "", true},
+		{"UnsupportedQop", map[string]string{"realm": "r", "nonce": "n", "qop": "auth-int"}, "u", "p", "c", "", true},
+	}
+	defer func(f func() string) { newCnonce = f }(newCnonce)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newCnonce = func() string { return tt.cnonce }
+			got, err := digestAuthorization(tt.params, tt.user, tt.pass, http.MethodGet, "/dir/index.html")
+			if tt.wantErr {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Assert(t, strings.HasPrefix(got, `Digest username="Mufasa", `), got)
+			assert.Assert(t, strings.Contains(got, tt.wantResponse), got)
+			assert.Assert(t, strings.Contains(got, `, qop=auth, nc=00000001, cnonce="`+tt.cnonce+`"`), got)
+			assert.Assert(t, strings.Contains(got, `, opaque="`+tt.params["opaque"]+`"`), got)
+		})
+	}
+}
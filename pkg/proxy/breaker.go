@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerThreshold    = 5
+	defaultBreakerOpenDuration = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned for connections through an upstream proxy whose circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// A CircuitBreaker makes connections through an upstream proxy fail fast while it keeps failing
+//
+// The circuit is closed while the proxy works and opens after Threshold consecutive failures.
+// Connections through the proxy then fail right away with ErrCircuitOpen, groups falling back
+// to their other members. Once OpenDuration elapsed the circuit is half-open: a single trial
+// connection is let through, closing the circuit if it succeeds or opening it again otherwise.
+//
+// Failures are errors connecting to the proxy, 5xx or 407 responses to CONNECT requests and
+// 502, 503 or 504 responses to plain requests, which proxies use to report they could not reach
+// the target. Other refusals (ie. a 403 for a blocked site) depend on the target and are ignored.
+type CircuitBreaker struct {
+	// Threshold is the number of consecutive failures opening the circuit, defaults to 5
+	Threshold int
+	// OpenDuration is how long the circuit stays open before a trial connection, defaults to 30 seconds
+	OpenDuration time.Duration
+}
+
+// Validate checks that the circuit breaker options are not negative
+func (b *CircuitBreaker) Validate() error {
+	if b.Threshold < 0 || b.OpenDuration < 0 {
+		return fmt.Errorf("circuit breaker threshold and open duration can not be negative")
+	}
+	return nil
+}
+
+// A CircuitState is the state of a circuit breaker
+type CircuitState string
+
+const (
+	// CircuitClosed lets connections through
+	CircuitClosed CircuitState = "closed"
+	// CircuitOpen makes connections fail fast
+	CircuitOpen CircuitState = "open"
+	// CircuitHalfOpen lets a single trial connection through
+	CircuitHalfOpen CircuitState = "half-open"
+)
+
+// CircuitStatus is the state of the circuit breaker of an upstream
+type CircuitStatus struct {
+	State CircuitState `json:"state"`
+	// Failures is the number of consecutive failures
+	Failures int `json:"failures"`
+	// OpenUntil is the time of the next trial connection when the circuit is open
+	OpenUntil time.Time `json:"open_until,omitempty"`
+	// LastError is the error of the last failure
+	LastError string `json:"last_error,omitempty"`
+}
+
+// breaker tracks the state of the circuit breaker of an upstream
+type breaker struct {
+	mu        sync.Mutex
+	state     CircuitState
+	failures  int
+	openUntil time.Time
+	lastError string
+	// trial is true while the trial connection of a half-open circuit is in progress
+	trial bool
+}
+
+// Circuit returns the status of the upstream circuit breaker, the circuit of upstreams without breaker is always closed
+func (u *Upstream) Circuit() CircuitStatus {
+	b := &u.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := CircuitStatus{State: b.currentState(), Failures: b.failures, LastError: b.lastError}
+	if status.State == CircuitOpen {
+		status.OpenUntil = b.openUntil
+	}
+	return status
+}
+
+// currentState returns the state of the circuit, it should be called with the lock held
+func (b *breaker) currentState() CircuitState {
+	switch {
+	case b.state == "":
+		return CircuitClosed
+	case b.state == CircuitOpen && !time.Now().Before(b.openUntil):
+		return CircuitHalfOpen
+	default:
+		return b.state
+	}
+}
+
+// available returns false if connections through the upstream would fail fast
+func (u *Upstream) available() bool {
+	if u.CircuitBreaker == nil {
+		return true
+	}
+	b := &u.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return !b.trial
+	default:
+		return true
+	}
+}
+
+// allow returns an error wrapping ErrCircuitOpen if a connection through the upstream should fail fast,
+// otherwise the outcome of the connection should be given to recordOutcome
+func (u *Upstream) allow() error {
+	if u.CircuitBreaker == nil {
+		return nil
+	}
+	b := &u.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.currentState() {
+	case CircuitOpen:
+		return fmt.Errorf("upstream proxy %s failed %d times, retrying after %s: %w",
+			u.URL.Redacted(), b.failures, b.openUntil.Format(time.RFC3339), ErrCircuitOpen)
+	case CircuitHalfOpen:
+		if b.trial {
+			return fmt.Errorf("upstream proxy %s failed %d times, waiting for a trial connection: %w",
+				u.URL.Redacted(), b.failures, ErrCircuitOpen)
+		}
+		if b.state == CircuitOpen {
+			b.state = CircuitHalfOpen
+			slog.Info("Circuit breaker of upstream proxy is half-open, trying it", "proxy", proxyName(u))
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// recordOutcome updates the circuit breaker of the upstream with the outcome of a connection
+func (u *Upstream) recordOutcome(result any, err error) {
+	if u.CircuitBreaker == nil {
+		return
+	}
+	b := &u.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	halfOpen := b.state == CircuitHalfOpen
+	b.trial = false
+	var limitErr *connLimitError
+	if errors.As(err, &limitErr) {
+		// waiting for one of the MaxConns connections tells nothing about the proxy health
+		return
+	}
+	failure := breakerFailure(result, err)
+	logger := slog.With(slog.String("proxy", proxyName(u)))
+	if failure == nil {
+		if b.state != "" {
+			logger.Info("Circuit breaker of upstream proxy closed")
+		}
+		b.state = ""
+		b.failures = 0
+		return
+	}
+	b.failures++
+	b.lastError = failure.Error()
+	if halfOpen || (b.state == "" && b.failures >= defaultInt(u.CircuitBreaker.Threshold, defaultBreakerThreshold)) {
+		openDuration := defaultDuration(u.CircuitBreaker.OpenDuration, defaultBreakerOpenDuration)
+		b.state = CircuitOpen
+		b.openUntil = time.Now().Add(openDuration)
+		logger.Warn("Circuit breaker of upstream proxy opened, failing fast", "error", failure, "failures", b.failures, "open_duration", openDuration)
+	}
+}
+
+// breakerFailure returns the error to count as a failure of the upstream from the result of a connection through it
+func breakerFailure(result any, err error) error {
+	if err != nil {
+		var upstreamErr *UpstreamError
+		switch {
+		case errors.Is(err, context.Canceled):
+			// the client went away
+			return nil
+		case errors.As(err, &upstreamErr):
+			if upstreamErr.StatusCode >= 500 || upstreamErr.StatusCode == http.StatusProxyAuthRequired {
+				return err
+			}
+			return nil
+		default:
+			return err
+		}
+	}
+	if resp, ok := result.(*http.Response); ok {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusProxyAuthRequired:
+			return fmt.Errorf("upstream proxy responded %s", resp.Status)
+		}
+	}
+	return nil
+}
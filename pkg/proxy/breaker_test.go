@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	var failing, refused atomic.Bool
+	failing.Store(true)
+	flaky := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if failing.Load() {
+			refused.Store(true)
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	})
+	upstream := makeUpstream(t, "http://"+flaky.Listener.Addr().String())
+	upstream.CircuitBreaker = &CircuitBreaker{Threshold: 2, OpenDuration: 100 * time.Millisecond}
+	assert.NilError(t, upstream.Validate())
+	p := &Profile{Default: upstream}
+
+	for i := 0; i < 2; i++ {
+		_, err := p.dial(req, "tcp", target.Listener.Addr().String())
+		assert.ErrorContains(t, err, "503 Service Unavailable")
+	}
+	assert.Equal(t, upstream.Circuit().State, CircuitOpen)
+	refused.Store(false)
+	_, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.Assert(t, errors.Is(err, ErrCircuitOpen), err)
+	assert.Assert(t, !refused.Load(), "open circuit should fail fast")
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, upstream.Circuit().State, CircuitHalfOpen)
+	_, err = p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.ErrorContains(t, err, "503 Service Unavailable")
+	assert.Equal(t, upstream.Circuit().State, CircuitOpen, "failed trial should open the circuit again")
+
+	time.Sleep(150 * time.Millisecond)
+	failing.Store(false)
+	c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	assert.Equal(t, upstream.Circuit().State, CircuitClosed)
+	assert.Equal(t, upstream.Circuit().Failures, 0)
+}
+
+func TestCircuitBreaker_groupFallback(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	dead := newDeadUpstream(t)
+	dead.CircuitBreaker = &CircuitBreaker{Threshold: 1, OpenDuration: time.Minute}
+	working := newFakeUpstream(t, nil)
+	group := NewGroup("corporate", dead, makeUpstream(t, "http://"+working.Listener.Addr().String()))
+	// members are not skipped by the group itself so that only the breaker applies
+	group.Group.CoolDown = time.Nanosecond
+	p := &Profile{Default: group}
+
+	for i := 0; i < 2; i++ {
+		c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+		assert.NilError(t, err)
+		assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	}
+	assert.Equal(t, dead.Circuit().State, CircuitOpen)
+	assert.Equal(t, dead.Circuit().Failures, 1, "open circuit should skip the member")
+	assert.Equal(t, len(group.Group.candidates("")), 1)
+}
+
+func TestCircuitBreaker_connectionsLimit(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	overloaded := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		return false
+	})
+	upstream := makeUpstream(t, "http://"+overloaded.Listener.Addr().String())
+	upstream.MaxConns = 1
+	upstream.ConnectTimeout = 100 * time.Millisecond
+	upstream.CircuitBreaker = &CircuitBreaker{Threshold: 2}
+	assert.NilError(t, upstream.Validate())
+	p := &Profile{Default: upstream}
+
+	_, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.ErrorContains(t, err, "503 Service Unavailable")
+	assert.Equal(t, upstream.Circuit().Failures, 1)
+
+	release, err := upstream.acquireConn(context.Background())
+	assert.NilError(t, err)
+	defer release()
+	for i := 0; i < 2; i++ {
+		_, err = p.dial(req, "tcp", target.Listener.Addr().String())
+		assert.ErrorContains(t, err, "no connection to upstream proxy")
+	}
+	assert.Equal(t, upstream.Circuit().State, CircuitClosed, "waiting for a connection is not a failure of the proxy")
+	assert.Equal(t, upstream.Circuit().Failures, 1, "waiting for a connection is not a success either")
+}
+
+func Test_proxyCircuitBreaker(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no route to origin", http.StatusGatewayTimeout)
+	}))
+	t.Cleanup(target.Close)
+	upstream := makeUpstream(t, "http://"+newFakeUpstream(t, nil).Listener.Addr().String())
+	upstream.CircuitBreaker = &CircuitBreaker{Threshold: 1}
+	p := newProxy()
+	profile, err := NewProfile(upstream, nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+
+	codes := make([]int, 0, 2)
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, target.URL, nil)
+		r.RequestURI = ""
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	assert.DeepEqual(t, codes, []int{http.StatusGatewayTimeout, http.StatusBadGateway})
+	assert.Equal(t, upstream.Circuit().LastError, "upstream proxy responded 504 Gateway Timeout")
+}
+
+func Test_breakerFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		result  any
+		err     error
+		failure bool
+	}{
+		{"Success", nil, nil, false},
+		{"DialError", nil, errors.New("connection refused"), true},
+		{"Canceled", nil, fmt.Errorf("dial: %w", context.Canceled), false},
+		{"BadGateway", nil, &UpstreamError{StatusCode: http.StatusBadGateway}, true},
+		{"ProxyAuthRequired", nil, &UpstreamError{StatusCode: http.StatusProxyAuthRequired}, true},
+		{"Forbidden", nil, &UpstreamError{StatusCode: http.StatusForbidden}, false},
+		{"OK", &http.Response{StatusCode: http.StatusOK}, nil, false},
+		{"InternalServerError", &http.Response{StatusCode: http.StatusInternalServerError}, nil, false},
+		{"ServiceUnavailable", &http.Response{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, breakerFailure(tt.result, tt.err) != nil, tt.failure)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -10,14 +11,28 @@ import (
 	"time"
 )
 
+// waitForListener waits for a server started in a goroutine to accept connections
+func waitForListener(t *testing.T, addr string) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("server %s is not listening", addr)
+}
+
 func TestProxy(t *testing.T) {
 	expectedContent := `Hello that's all folks!`
 	s := Server{Addr: ":9988"}
 	s.SetupProfile(&Profile{
-		Default: makeURL(t, "http://127.0.0.1:9989"),
+		Default: makeUpstream(t, "http://127.0.0.1:9989"),
 		Rules: []Rule{
-			{Pattern: "something.*", Proxy: makeURL(t, "http://127.0.0.1:9998")},
-			{Pattern: "wrongproxy.*", Proxy: makeURL(t, "wrongproto://127.0.0.1:9998")},
+			{Pattern: "something.*", Proxy: makeUpstream(t, "http://127.0.0.1:9998")},
+			{Pattern: "wrongproxy.*", Proxy: makeUpstream(t, "wrongproto://127.0.0.1:9998")},
 		},
 	})
 
@@ -29,6 +44,8 @@ func TestProxy(t *testing.T) {
 	})
 
 	go s2.ListenAndServe()
+	waitForListener(t, s.Addr)
+	waitForListener(t, s2.Addr)
 
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -0,0 +1,593 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+	"golang.org/x/crypto/ssh"
+)
+
+// A fakeUpstream is an in-process upstream HTTP proxy used to test how Sweetcher talks to upstream proxies
+type fakeUpstream struct {
+	*httptest.Server
+	// authorize checks the Proxy-Authorization of requests, nil means no authentication
+	authorize func(w http.ResponseWriter, r *http.Request) bool
+	// connects counts the CONNECT requests successfully tunneled
+	connects int64
+	// requests counts the plain HTTP requests successfully forwarded
+	requests int64
+	// conns counts the connections accepted by the server
+	conns int64
+}
+
+func newFakeUpstream(t *testing.T, authorize func(w http.ResponseWriter, r *http.Request) bool) *fakeUpstream {
+	f := &fakeUpstream{authorize: authorize}
+	f.Server = httptest.NewUnstartedServer(f)
+	f.Server.Config.ConnState = f.countConns
+	f.Start()
+	t.Cleanup(f.Close)
+	return f
+}
+
+// newFakeHTTP2Upstream starts a fakeUpstream serving TLS and negotiating HTTP/2
+func newFakeHTTP2Upstream(t *testing.T) *fakeUpstream {
+	f := &fakeUpstream{}
+	f.Server = httptest.NewUnstartedServer(f)
+	f.Server.EnableHTTP2 = true
+	f.Server.Config.ConnState = f.countConns
+	f.StartTLS()
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeUpstream) countConns(_ net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		atomic.AddInt64(&f.conns, 1)
+	}
+}
+
+// newFakeTLSUpstream starts a fakeUpstream serving TLS, config customizes the server TLS configuration
+func newFakeTLSUpstream(t *testing.T, config func(c *tls.Config)) *fakeUpstream {
+	f := &fakeUpstream{}
+	f.Server = httptest.NewUnstartedServer(f)
+	f.Server.TLS = &tls.Config{}
+	// handshake failures are expected by tests
+	f.Server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	f.Server.Config.ConnState = f.countConns
+	if config != nil {
+		config(f.Server.TLS)
+	}
+	f.StartTLS()
+	t.Cleanup(f.Close)
+	return f
+}
+
+// basicAuthorizer accepts requests with the given basic credentials
+func basicAuthorizer(user, password string) func(w http.ResponseWriter, r *http.Request) bool {
+	expected, _ := proxyAuthorization(makeUserURL(user, password))
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Proxy-Authorization") == expected {
+			return true
+		}
+		w.Header().Set("Proxy-Authenticate", `Basic realm="fake"`)
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+		return false
+	}
+}
+
+// ntlmAuthorizer accepts requests authenticated with NTLMv2 using the given credentials in the CORP domain.
+// As NTLM authenticates connections, challenges are tracked by client address.
+func ntlmAuthorizer(user, password string) func(w http.ResponseWriter, r *http.Request) bool {
+	var mu sync.Mutex
+	challenges := make(map[string][]byte)
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		token, _ := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "NTLM ")
+		msg, _ := base64.StdEncoding.DecodeString(token)
+		if len(msg) >= 12 && string(msg[:8]) == "NTLMSSP\x00" {
+			mu.Lock()
+			defer mu.Unlock()
+			switch binary.LittleEndian.Uint32(msg[8:]) {
+			case 1:
+				serverChallenge := make([]byte, 8)
+				_, _ = rand.Read(serverChallenge)
+				challenges[r.RemoteAddr] = serverChallenge
+				w.Header().Set("Proxy-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(ntlmChallengeMessage(serverChallenge)))
+				http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+				return false
+			case 3:
+				serverChallenge := challenges[r.RemoteAddr]
+				delete(challenges, r.RemoteAddr)
+				if serverChallenge != nil && checkNTLMAuthenticate(msg, serverChallenge, user, password) {
+					return true
+				}
+			}
+		}
+		w.Header().Add("Proxy-Authenticate", "NTLM")
+		w.Header().Add("Proxy-Authenticate", `Basic realm="fake"`)
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+		return false
+	}
+}
+
+// ntlmChallengeMessage builds an NTLM CHALLENGE message for the CORP domain
+func ntlmChallengeMessage(serverChallenge []byte) []byte {
+	target := utf16LE("CORP")
+	targetInfo := []byte{0, 0, 0, 0} // MsvAvEOL
+	msg := make([]byte, 48, 48+len(target)+len(targetInfo))
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	putNTLMField(msg[12:], len(target), 48)
+	// unicode, request target, NTLM and target info
+	binary.LittleEndian.PutUint32(msg[20:], 0x1|0x4|0x200|0x800000)
+	copy(msg[24:], serverChallenge)
+	putNTLMField(msg[40:], len(targetInfo), 48+len(target))
+	return append(append(msg, target...), targetInfo...)
+}
+
+func putNTLMField(b []byte, length, offset int) {
+	binary.LittleEndian.PutUint16(b, uint16(length))
+	binary.LittleEndian.PutUint16(b[2:], uint16(length))
+	binary.LittleEndian.PutUint32(b[4:], uint32(offset))
+}
+
+func ntlmField(msg []byte, at int) []byte {
+	length := int(binary.LittleEndian.Uint16(msg[at:]))
+	offset := int(binary.LittleEndian.Uint32(msg[at+4:]))
+	if offset+length > len(msg) {
+		return nil
+	}
+	return msg[offset : offset+length]
+}
+
+// checkNTLMAuthenticate verifies the NTLMv2 response of an AUTHENTICATE message
+func checkNTLMAuthenticate(msg, serverChallenge []byte, user, password string) bool {
+	if len(msg) < 44 {
+		return false
+	}
+	ntResponse := ntlmField(msg, 20)
+	domain, msgUser := ntlmField(msg, 28), ntlmField(msg, 36)
+	if len(ntResponse) < 16 || !bytes.Equal(msgUser, utf16LE(user)) {
+		return false
+	}
+	ntlmHash := md4.New()
+	ntlmHash.Write(utf16LE(password))
+	v2Hash := hmac.New(md5.New, ntlmHash.Sum(nil))
+	v2Hash.Write(utf16LE(strings.ToUpper(user)))
+	v2Hash.Write(domain)
+	proof := hmac.New(md5.New, v2Hash.Sum(nil))
+	proof.Write(serverChallenge)
+	proof.Write(ntResponse[16:])
+	return hmac.Equal(proof.Sum(nil), ntResponse[:16])
+}
+
+func utf16LE(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return b
+}
+
+// digestAuthorizer accepts requests authenticated with MD5 Digest using the given credentials
+func digestAuthorizer(user, password string) func(w http.ResponseWriter, r *http.Request) bool {
+	const realm, nonce = "fake", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+	md5Hex := func(parts ...string) string {
+		sum := md5.Sum([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum[:])
+	}
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if v, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Digest "); ok {
+			p := parseAuthParams(v)
+			expected := md5Hex(md5Hex(user, realm, password), nonce, p["nc"], p["cnonce"], "auth", md5Hex(r.Method, r.RequestURI))
+			if p["username"] == user && p["uri"] == r.RequestURI && p["opaque"] == "5ccc" && p["response"] == expected {
+				return true
+			}
+		}
+		w.Header().Add("Proxy-Authenticate", `Basic realm="fake"`)
+		w.Header().Add("Proxy-Authenticate", `Digest realm="fake", qop="auth,auth-int", nonce="`+nonce+`", opaque="5ccc"`)
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+		return false
+	}
+}
+
+func makeUserURL(user, password string) *url.URL {
+	return &url.URL{Scheme: "http", User: url.UserPassword(user, password), Host: "fake"}
+}
+
+func (f *fakeUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.authorize != nil && !f.authorize(w, r) {
+		return
+	}
+	if r.Method == http.MethodConnect {
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt64(&f.connects, 1)
+		if r.ProtoMajor == 2 {
+			// HTTP/2 tunnels are streams, the request body is sent to the target and its data is the response body
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			go func() {
+				_, _ = io.Copy(target, r.Body)
+				target.Close()
+			}()
+			_, _ = io.Copy(flushWriter{w}, target)
+			return
+		}
+		client, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		_, _ = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipeConns(client, brw, target)
+		return
+	}
+	r.RequestURI = ""
+	r.Header.Del("Proxy-Authorization")
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	atomic.AddInt64(&f.requests, 1)
+	copyHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+// flushWriter flushes each write so that tunneled data is not buffered
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.w.(http.Flusher).Flush()
+	return n, err
+}
+
+// pipeConns copies data between two connections until one of them is closed
+func pipeConns(client net.Conn, clientReader io.Reader, target net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(target, clientReader)
+		target.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(client, target)
+		client.Close()
+	}()
+	wg.Wait()
+}
+
+// newSilentListener accepts connections and never writes to them, like a wedged server
+func newSilentListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+	return l
+}
+
+// A fakeSocks is an in-process SOCKS server supporting SOCKS4, SOCKS4a and SOCKS5 with username/password authentication
+type fakeSocks struct {
+	net.Listener
+	user, password string
+	// hosts resolves the hostnames of requested destinations, others are resolved by the system
+	hosts map[string]string
+	// targets records the requested destinations
+	mu      sync.Mutex
+	targets []string
+}
+
+func newFakeSocks(t *testing.T, user, password string) *fakeSocks {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSocks{Listener: l, user: user, password: password}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// lastTarget returns the last destination requested to the server
+func (f *fakeSocks) lastTarget() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.targets) == 0 {
+		return ""
+	}
+	return f.targets[len(f.targets)-1]
+}
+
+func (f *fakeSocks) connect(addr string) (net.Conn, error) {
+	f.mu.Lock()
+	f.targets = append(f.targets, addr)
+	f.mu.Unlock()
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip, ok := f.hosts[host]; ok {
+		addr = net.JoinHostPort(ip, port)
+	}
+	return net.Dial("tcp", addr)
+}
+
+func (f *fakeSocks) serve(c net.Conn) {
+	defer c.Close()
+	buf := make([]byte, 262)
+	// greeting: version, nmethods, methods
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		return
+	}
+	if buf[0] == 4 {
+		f.serveSocks4(c, buf[1])
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		return
+	}
+	if f.user == "" {
+		c.Write([]byte{5, 0})
+	} else {
+		c.Write([]byte{5, 2})
+		// username/password sub negotiation
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(c, password)
+		if string(user) != f.user || string(password) != f.password {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+	// request: version, command, reserved, address type
+	if _, err := io.ReadFull(c, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(c, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(c, buf[:1])
+		name := make([]byte, buf[0])
+		io.ReadFull(c, name)
+		host = string(name)
+	case 4:
+		io.ReadFull(c, buf[:16])
+		host = net.IP(buf[:16]).String()
+	}
+	io.ReadFull(c, buf[:2])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	target, err := f.connect(addr)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipeConns(c, c, target)
+}
+
+// serveSocks4 handles a SOCKS4 request once its version and command have been read, the user id is checked against the user
+func (f *fakeSocks) serveSocks4(c net.Conn, command byte) {
+	br := bufio.NewReader(c)
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(br, buf); err != nil || command != 1 {
+		return
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(buf)))
+	host := net.IP(buf[2:6]).String()
+	userID, err := br.ReadString(0)
+	if err != nil {
+		return
+	}
+	if buf[2] == 0 && buf[3] == 0 && buf[4] == 0 && buf[5] != 0 {
+		// SOCKS4a hostname
+		host, err = br.ReadString(0)
+		if err != nil {
+			return
+		}
+		host = strings.TrimSuffix(host, "\x00")
+	}
+	if strings.TrimSuffix(userID, "\x00") != f.user {
+		c.Write([]byte{0, 93, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	target, err := f.connect(net.JoinHostPort(host, port))
+	if err != nil {
+		c.Write([]byte{0, 91, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	c.Write([]byte{0, 90, 0, 0, 0, 0, 0, 0})
+	pipeConns(c, br, target)
+}
+
+// A fakeSSH is an in-process SSH server accepting direct-tcpip channels, authenticating users
+// with a password or one of the authorized keys
+type fakeSSH struct {
+	net.Listener
+	hostKey        ssh.Signer
+	user, password string
+	authorized     []ssh.PublicKey
+	// handshakes counts the successful SSH handshakes
+	handshakes int64
+	mu         sync.Mutex
+	conns      []*ssh.ServerConn
+}
+
+func newFakeSSH(t *testing.T, user, password string, authorized ...ssh.PublicKey) *fakeSSH {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSSH{Listener: l, hostKey: newSSHSigner(t), user: user, password: password, authorized: authorized}
+	t.Cleanup(func() {
+		l.Close()
+		f.disconnect()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// newSSHSigner generates an ed25519 key
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// disconnect closes the connections of the clients as if the server was restarted
+func (f *fakeSSH) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeSSH) serve(c net.Conn) {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if f.password != "" && meta.User() == f.user && string(password) == f.password {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range f.authorized {
+				if meta.User() == f.user && bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	config.AddHostKey(f.hostKey)
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	atomic.AddInt64(&f.handshakes, 1)
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.mu.Unlock()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip channels are supported")
+			continue
+		}
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		go func() {
+			go func() {
+				_, _ = io.Copy(target, channel)
+				target.Close()
+			}()
+			_, _ = io.Copy(channel, target)
+			channel.Close()
+		}()
+	}
+}
@@ -0,0 +1,340 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCoolDown is the CoolDown of groups not defining one
+const defaultCoolDown = 30 * time.Second
+
+// A GroupStrategy defines the order in which the members of a Group are tried
+type GroupStrategy string
+
+const (
+	// Failover groups try their members in order, this is the default strategy
+	Failover GroupStrategy = "failover"
+	// RoundRobin groups start with the next member for each new connection
+	RoundRobin GroupStrategy = "round_robin"
+	// LeastConnections groups start with the member having the least active connections
+	LeastConnections GroupStrategy = "least_connections"
+	// ConsistentHash groups always start with the same member for a given target host,
+	// so a site sees the same egress IP while members are available
+	ConsistentHash GroupStrategy = "consistent_hash"
+	// Latency groups start with the member having the lowest latency (see LatencyStatus).
+	// Members without recent measurements are tried first so that they get measured.
+	Latency GroupStrategy = "latency"
+)
+
+// A Group is a set of upstreams used as a single proxy
+//
+// Members are tried in the order defined by the Strategy until one of them succeeds,
+// a nil member stands for a direct connection. Members failing to connect, or refusing connections
+// with a 5xx status, are remembered as failed and skipped for the CoolDown duration. Other refusals
+// (ie. a 403 for a blocked site) and failures of direct connections only make the next member to be
+// tried as they depend on the target. Members considered down by their HealthCheck or whose
+// CircuitBreaker is open are skipped too.
+type Group struct {
+	Name    string
+	Members []*Upstream
+	// Strategy defaults to Failover
+	Strategy GroupStrategy
+	// CoolDown is how long failed members are skipped, defaults to 30 seconds
+	CoolDown time.Duration
+
+	mu          sync.Mutex
+	failedUntil map[*Upstream]time.Time
+	// active counts the connections in use by member for LeastConnections groups
+	active map[*Upstream]int
+	// next is the index of the member RoundRobin groups start with
+	next uint64
+	// direct holds the latency of direct connections of Latency groups
+	direct latency
+	// fastest is the member Latency groups started with last time
+	fastest *Upstream
+}
+
+// NewGroup creates an upstream dispatching connections to a group of upstreams
+func NewGroup(name string, members ...*Upstream) *Upstream {
+	return &Upstream{
+		URL:   &url.URL{Scheme: "group", Opaque: name},
+		Group: &Group{Name: name, Members: members},
+	}
+}
+
+// Validate checks that the group members are supported
+func (g *Group) Validate() error {
+	if len(g.Members) == 0 {
+		return fmt.Errorf("group %q has no member", g.Name)
+	}
+	switch g.Strategy {
+	case "", Failover, RoundRobin, LeastConnections, ConsistentHash, Latency:
+	default:
+		return fmt.Errorf("unsupported strategy %q for group %q", g.Strategy, g.Name)
+	}
+	for _, m := range g.Members {
+		switch {
+		case m == Reject:
+			return fmt.Errorf("group %q can not reject requests", g.Name)
+		case m != nil && m.Group != nil:
+			return fmt.Errorf("group %q can not contain group %q", g.Name, m.Group.Name)
+		}
+	}
+	return nil
+}
+
+// candidates returns the members to try in order for a connection to host, skipping the ones that recently failed
+// or are down
+func (g *Group) candidates(host string) []*Upstream {
+	members := g.ordered(host)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	candidates := make([]*Upstream, 0, len(members))
+	for _, m := range members {
+		if until, ok := g.failedUntil[m]; ok && now.Before(until) {
+			continue
+		}
+		if m != nil && (!m.healthy() || !m.available()) {
+			continue
+		}
+		candidates = append(candidates, m)
+	}
+	if len(candidates) == 0 {
+		// all members recently failed, trying them again is better than failing right away
+		return members
+	}
+	return candidates
+}
+
+// ordered returns the members in the order defined by the group strategy
+func (g *Group) ordered(host string) []*Upstream {
+	members := make([]*Upstream, len(g.Members))
+	switch g.Strategy {
+	case RoundRobin:
+		start := int((atomic.AddUint64(&g.next, 1) - 1) % uint64(len(g.Members)))
+		copy(members, g.Members[start:])
+		copy(members[len(g.Members)-start:], g.Members[:start])
+	case LeastConnections:
+		copy(members, g.Members)
+		g.mu.Lock()
+		sort.SliceStable(members, func(i, j int) bool { return g.active[members[i]] < g.active[members[j]] })
+		g.mu.Unlock()
+	case ConsistentHash:
+		// rendezvous hashing: adding or removing a member only moves the hosts it was chosen for
+		weights := make(map[*Upstream]uint64, len(g.Members))
+		for _, m := range g.Members {
+			h := fnv.New64a()
+			h.Write([]byte(host))
+			h.Write([]byte{0})
+			h.Write([]byte(proxyName(m)))
+			weights[m] = h.Sum64()
+		}
+		copy(members, g.Members)
+		sort.SliceStable(members, func(i, j int) bool { return weights[members[i]] > weights[members[j]] })
+	case Latency:
+		scores := make(map[*Upstream]time.Duration, len(g.Members))
+		for _, m := range g.Members {
+			if status := g.latencyOf(m).get(); status.fresh() {
+				scores[m] = status.score()
+			}
+		}
+		copy(members, g.Members)
+		sort.SliceStable(members, func(i, j int) bool {
+			si, measuredI := scores[members[i]]
+			sj, measuredJ := scores[members[j]]
+			if measuredI != measuredJ {
+				return !measuredI
+			}
+			return si < sj
+		})
+		g.mu.Lock()
+		if members[0] != g.fastest {
+			if _, measured := scores[members[0]]; measured {
+				slog.Info("Fastest member of group changed", "group", g.Name, "proxy", proxyName(members[0]), "latency", scores[members[0]])
+			}
+			g.fastest = members[0]
+		}
+		g.mu.Unlock()
+	default:
+		copy(members, g.Members)
+	}
+	return members
+}
+
+// latencyOf returns the latency measurements of a member
+func (g *Group) latencyOf(member *Upstream) *latency {
+	if member == nil {
+		return &g.direct
+	}
+	return &member.latency
+}
+
+// acquire records a new active connection through a member of LeastConnections groups,
+// the returned function should be called once the connection is done. It returns nil for
+// other groups as they do not track connections.
+func (g *Group) acquire(member *Upstream) func() {
+	if g.Strategy != LeastConnections {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active == nil {
+		g.active = make(map[*Upstream]int)
+	}
+	g.active[member]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			g.active[member]--
+		})
+	}
+}
+
+// report records the outcome of a connection through a member
+func (g *Group) report(member *Upstream, err error) {
+	logger := slog.With(slog.String("group", g.Name), slog.String("proxy", proxyName(member)))
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		if _, ok := g.failedUntil[member]; ok {
+			delete(g.failedUntil, member)
+			logger.Info("Upstream proxy of group recovered")
+		}
+		return
+	}
+	if member == nil || !isProxyFailure(err) {
+		logger.Debug("Connection through member of group failed, trying next one", "error", err)
+		return
+	}
+	coolDown := g.CoolDown
+	if coolDown == 0 {
+		coolDown = defaultCoolDown
+	}
+	if g.failedUntil == nil {
+		g.failedUntil = make(map[*Upstream]time.Time)
+	}
+	g.failedUntil[member] = time.Now().Add(coolDown)
+	logger.Warn("Upstream proxy of group failed, skipping it", "error", err, "cool_down", coolDown)
+}
+
+// isProxyFailure returns false for refusals of a specific target by a working proxy
+func isProxyFailure(err error) bool {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode >= 500
+	}
+	return true
+}
+
+// failover calls try with the given upstream, or with the candidates of a group for a connection
+// to host until one of them succeeds. The result is given to track with a function to call once
+// it is not used anymore.
+//
+// The latency of successful attempts is recorded, as the time to establish a tunnel for net.Conn
+// results or as the time to receive the response headers for *http.Response results. Attempts
+// through upstreams whose circuit breaker is open fail fast.
+func failover[T any](upstream *Upstream, host string, try func(u *Upstream) (T, error), track func(v T, done func()) T) (T, error) {
+	if upstream == nil {
+		return try(nil)
+	}
+	if upstream.Group == nil {
+		return attempt(upstream, &upstream.latency, try)
+	}
+	g := upstream.Group
+	var v T
+	var err error
+	for _, member := range g.candidates(host) {
+		done := g.acquire(member)
+		v, err = attempt(member, g.latencyOf(member), try)
+		if errors.Is(err, ErrCircuitOpen) {
+			// the member is already known to be failing
+			logger := slog.With(slog.String("group", g.Name), slog.String("proxy", proxyName(member)))
+			logger.Debug("Skipping member of group", "error", err)
+		} else {
+			g.report(member, err)
+		}
+		switch {
+		case err == nil && done != nil:
+			return track(v, done), nil
+		case err == nil:
+			return v, nil
+		case done != nil:
+			done()
+		}
+		var stop *stopFailover
+		if errors.As(err, &stop) {
+			return v, fmt.Errorf("proxy %q of group %q failed: %w", proxyName(member), g.Name, stop.err)
+		}
+	}
+	return v, fmt.Errorf("all proxies of group %q failed, last error: %w", g.Name, err)
+}
+
+// A stopFailover error makes failover return the error it wraps without trying the next members,
+// ie. for a request which can not be sent twice
+type stopFailover struct {
+	err error
+}
+
+func (e *stopFailover) Error() string { return e.err.Error() }
+
+func (e *stopFailover) Unwrap() error { return e.err }
+
+// attempt calls try with an upstream, nil for direct connections, recording the latency of successful
+// attempts in l and feeding the upstream circuit breaker
+func attempt[T any](u *Upstream, l *latency, try func(u *Upstream) (T, error)) (T, error) {
+	if u != nil {
+		if err := u.allow(); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+	start := time.Now()
+	v, err := try(u)
+	if err == nil {
+		_, isConn := any(v).(net.Conn)
+		l.record(proxyName(u), time.Since(start), isConn)
+	}
+	if u != nil {
+		u.recordOutcome(v, err)
+	}
+	return v, err
+}
+
+// trackConn calls done when the connection is closed
+func trackConn(c net.Conn, done func()) net.Conn {
+	return &trackedConn{Conn: c, done: done}
+}
+
+// trackResponse calls done when the response body is closed
+func trackResponse(resp *http.Response, done func()) *http.Response {
+	return closeWithBody(resp, closerFunc(done))
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+type trackedConn struct {
+	net.Conn
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	defer c.done()
+	return c.Conn.Close()
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// newDeadUpstream returns an upstream refusing connections
+func newDeadUpstream(t *testing.T) *Upstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return makeUpstream(t, "http://"+addr)
+}
+
+func TestGroup_failover(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	working := newFakeUpstream(t, nil)
+	forbidding := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "blocked", http.StatusForbidden)
+		return false
+	})
+	dead := newDeadUpstream(t)
+	refusing := makeUpstream(t, "http://"+forbidding.Listener.Addr().String())
+
+	group := NewGroup("corporate", dead, refusing, makeUpstream(t, "http://"+working.Listener.Addr().String()), nil)
+	group.Group.CoolDown = 100 * time.Millisecond
+	assert.NilError(t, group.Validate())
+	p := &Profile{Default: group}
+
+	c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	assert.Equal(t, atomic.LoadInt64(&working.connects), int64(1))
+	candidates := group.Group.candidates("")
+	assert.Equal(t, len(candidates), 3, "dead proxy should be skipped")
+	assert.Equal(t, candidates[0], refusing, "proxies refusing a target should not be skipped")
+
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, len(group.Group.candidates("")), 4, "dead proxy should be tried again after the cool down")
+
+	// direct member
+	group = NewGroup("direct", dead, nil)
+	p = &Profile{Default: group}
+	c, err = p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+}
+
+func TestGroup_allMembersFailed(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	dead1, dead2 := newDeadUpstream(t), newDeadUpstream(t)
+	group := NewGroup("dead", dead1, dead2)
+	p := &Profile{Default: group}
+
+	_, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.ErrorContains(t, err, `all proxies of group "dead" failed`)
+	candidates := group.Group.candidates("")
+	assert.Equal(t, len(candidates), 2, "members should be tried again when all of them failed")
+	assert.Equal(t, candidates[0], dead1)
+}
+
+func Test_proxyGroupFailover(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(target.Close)
+	working := newFakeUpstream(t, nil)
+	p := newProxy()
+	profile, err := NewProfile(NewGroup("corporate", newDeadUpstream(t), makeUpstream(t, "http://"+working.Listener.Addr().String())), nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+
+	r := httptest.NewRequest(http.MethodPost, target.URL, strings.NewReader("ping"))
+	r.RequestURI = ""
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), "ping")
+	assert.Equal(t, atomic.LoadInt64(&working.requests), int64(1))
+}
+
+func Test_proxyGroupReplay(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	t.Cleanup(target.Close)
+	tests := []struct {
+		name          string
+		method        string
+		header        http.Header
+		digest        bool
+		wantForwarded int64
+	}{
+		{"Idempotent", http.MethodGet, nil, false, 1},
+		{"NotIdempotent", http.MethodPost, nil, false, 0},
+		{"IdempotencyKey", http.MethodPost, http.Header{"Idempotency-Key": {"42"}}, false, 1},
+		// requests to proxies requiring Digest authentication are written on dedicated connections
+		{"IdempotentDigest", http.MethodGet, nil, true, 1},
+		{"NotIdempotentDigest", http.MethodPost, nil, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dropped int64
+			authorize := func(http.ResponseWriter, *http.Request) bool { return true }
+			if tt.digest {
+				authorize = digestAuthorizer("jdoe", "s3cr3t")
+			}
+			// receives requests and closes their connection without answering
+			dropping := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) bool {
+				if !authorize(w, r) {
+					return false
+				}
+				atomic.AddInt64(&dropped, 1)
+				c, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					c.Close()
+				}
+				return false
+			})
+			droppingUpstream := makeUpstream(t, "http://"+dropping.Listener.Addr().String())
+			if tt.digest {
+				droppingUpstream = makeUpstream(t, "http://jdoe:s3cr3t@"+dropping.Listener.Addr().String())
+				droppingUpstream.Auth = authDigest
+			}
+			working := newFakeUpstream(t, nil)
+			p := newProxy()
+			profile, err := NewProfile(NewGroup("corporate",
+				droppingUpstream,
+				makeUpstream(t, "http://"+working.Listener.Addr().String())), nil)
+			assert.NilError(t, err)
+			p.SetProfile(profile)
+
+			r := httptest.NewRequest(tt.method, target.URL, strings.NewReader("ping"))
+			r.RequestURI = ""
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			assert.Equal(t, atomic.LoadInt64(&dropped), int64(1))
+			assert.Equal(t, atomic.LoadInt64(&working.requests), tt.wantForwarded)
+			if tt.wantForwarded == 0 {
+				assert.Equal(t, w.Code, http.StatusBadGateway)
+				return
+			}
+			assert.Equal(t, w.Code, http.StatusOK)
+			assert.Equal(t, w.Body.String(), "ping")
+		})
+	}
+}
+
+func TestGroup_Validate(t *testing.T) {
+	main := makeUpstream(t, "http://proxy:8080")
+	tests := []struct {
+		name    string
+		group   *Upstream
+		wantErr string
+	}{
+		{"Valid", NewGroup("corporate", main, nil), ""},
+		{"Empty", NewGroup("empty"), `group "empty" has no member`},
+		{"Reject", NewGroup("reject", main, Reject), "can not reject requests"},
+		{"Strategy", &Upstream{URL: makeURL(t, "group:balanced"), Group: &Group{Name: "balanced", Members: []*Upstream{main}, Strategy: ConsistentHash}}, ""},
+		{"UnsupportedStrategy", &Upstream{URL: makeURL(t, "group:random"), Group: &Group{Name: "random", Members: []*Upstream{main}, Strategy: "random"}}, `unsupported strategy "random" for group "random"`},
+		{"Nested", NewGroup("nested", main, NewGroup("other", main)), `group "nested" can not contain group "other"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.group.Validate()
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestGroup_strategies(t *testing.T) {
+	m1, m2, m3 := makeUpstream(t, "http://proxy1:8080"), makeUpstream(t, "http://proxy2:8080"), makeUpstream(t, "http://proxy3:8080")
+
+	t.Run("RoundRobin", func(t *testing.T) {
+		g := &Group{Name: "rr", Members: []*Upstream{m1, m2, m3}, Strategy: RoundRobin}
+		for _, want := range []*Upstream{m1, m2, m3, m1} {
+			candidates := g.candidates("www.google.com")
+			assert.Equal(t, len(candidates), 3)
+			assert.Equal(t, candidates[0], want)
+		}
+	})
+
+	t.Run("LeastConnections", func(t *testing.T) {
+		g := &Group{Name: "lc", Members: []*Upstream{m1, m2, m3}, Strategy: LeastConnections}
+		done1 := g.acquire(m1)
+		done2 := g.acquire(m2)
+		assert.Equal(t, g.candidates("")[0], m3)
+		g.acquire(m3)
+		done1()
+		done1()
+		assert.Equal(t, g.candidates("")[0], m1, "releasing twice should not count twice")
+		done2()
+		candidates := g.candidates("")
+		assert.Equal(t, candidates[0], m1)
+		assert.Equal(t, candidates[1], m2)
+	})
+
+	t.Run("ConsistentHash", func(t *testing.T) {
+		g := &Group{Name: "hash", Members: []*Upstream{m1, m2, m3}, Strategy: ConsistentHash}
+		without3 := &Group{Name: "hash", Members: []*Upstream{m1, m2}, Strategy: ConsistentHash}
+		chosen := make(map[*Upstream]int)
+		for i := 0; i < 300; i++ {
+			host := fmt.Sprintf("site%d.example.com", i)
+			first := g.candidates(host)[0]
+			assert.Equal(t, g.candidates(host)[0], first, "a host should always use the same member")
+			if first != m3 {
+				assert.Equal(t, without3.candidates(host)[0], first, "removing a member should not move other hosts")
+			}
+			chosen[first]++
+		}
+		for _, m := range []*Upstream{m1, m2, m3} {
+			assert.Assert(t, chosen[m] > 50, "hosts should be spread across members: %v", chosen)
+		}
+	})
+}
+
+func TestGroup_leastConnectionsDial(t *testing.T) {
+	target := newHelloServer(t)
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	u1, u2 := newFakeUpstream(t, nil), newFakeUpstream(t, nil)
+	group := NewGroup("lc", makeUpstream(t, "http://"+u1.Listener.Addr().String()), makeUpstream(t, "http://"+u2.Listener.Addr().String()))
+	group.Group.Strategy = LeastConnections
+	p := &Profile{Default: group}
+
+	c1, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	c2, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, atomic.LoadInt64(&u1.connects), int64(1))
+	assert.Equal(t, atomic.LoadInt64(&u2.connects), int64(1))
+
+	assert.Equal(t, getThroughTunnel(t, c1, target.URL), "hello")
+	c3, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, atomic.LoadInt64(&u1.connects), int64(2), "closed connections should not be counted")
+	c2.Close()
+	c3.Close()
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A HealthCheckKind defines how an upstream proxy is probed
+type HealthCheckKind string
+
+const (
+	// HealthCheckTCP probes open a connection to the proxy, this is the default kind
+	HealthCheckTCP HealthCheckKind = "tcp"
+	// HealthCheckConnect probes open a connection to the Target host through the proxy
+	HealthCheckConnect HealthCheckKind = "connect"
+	// HealthCheckHTTP probes send a GET request to the Target URL through the proxy,
+	// any response but a 5xx or a 407 is a success
+	HealthCheckHTTP HealthCheckKind = "http"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// A HealthCheck periodically probes an upstream proxy in the background
+//
+// Upstreams are considered up until Fall consecutive probes fail, then down until Rise
+// consecutive probes succeed. Groups skip their members that are down.
+type HealthCheck struct {
+	// Kind defaults to HealthCheckTCP
+	Kind HealthCheckKind
+	// Target is the canary "host:port" of HealthCheckConnect probes or the URL of HealthCheckHTTP probes
+	Target string
+	// Interval between probes, defaults to 30 seconds
+	Interval time.Duration
+	// Timeout of probes, defaults to 5 seconds
+	Timeout time.Duration
+	// Rise is the number of consecutive successful probes for a down upstream to be up again, defaults to 2
+	Rise int
+	// Fall is the number of consecutive failed probes for an up upstream to be down, defaults to 3
+	Fall int
+}
+
+// Validate checks that the health check kind is supported and has a target if required
+func (c *HealthCheck) Validate() error {
+	switch c.Kind {
+	case "", HealthCheckTCP:
+	case HealthCheckConnect, HealthCheckHTTP:
+		if c.Target == "" {
+			return fmt.Errorf("%s health checks require a target", c.Kind)
+		}
+	default:
+		return fmt.Errorf("unsupported health check kind %q, should be one of %q, %q or %q", c.Kind, HealthCheckTCP, HealthCheckConnect, HealthCheckHTTP)
+	}
+	if c.Rise < 0 || c.Fall < 0 || c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("health check durations and thresholds can not be negative")
+	}
+	return nil
+}
+
+func defaultInt(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func defaultDuration(v, def time.Duration) time.Duration {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// HealthStatus is the result of the health checks of an upstream
+type HealthStatus struct {
+	// Healthy is false once the upstream is considered down
+	Healthy bool `json:"healthy"`
+	// LastCheck is the time of the last probe, zero if the upstream was never probed
+	LastCheck time.Time `json:"last_check,omitempty"`
+	// LastError is the error of the last probe if it failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+// health tracks the state of an upstream from its probes
+type health struct {
+	mu        sync.Mutex
+	down      bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+// Health returns the status of the upstream health checks, upstreams without health check are always healthy
+func (u *Upstream) Health() HealthStatus {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	return HealthStatus{Healthy: !u.health.down, LastCheck: u.health.lastCheck, LastError: u.health.lastError}
+}
+
+// healthy returns false for upstreams considered down by their health checks
+func (u *Upstream) healthy() bool {
+	u.health.mu.Lock()
+	defer u.health.mu.Unlock()
+	return !u.health.down
+}
+
+// recordProbe updates the health state of the upstream with the result of a probe
+func (u *Upstream) recordProbe(err error) {
+	c := u.HealthCheck
+	h := &u.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCheck = time.Now()
+	logger := slog.With(slog.String("proxy", proxyName(u)))
+	if err == nil {
+		h.lastError = ""
+		h.failures = 0
+		h.successes++
+		if h.down && h.successes >= defaultInt(c.Rise, defaultHealthCheckRise) {
+			h.down = false
+			logger.Info("Upstream proxy is up")
+		}
+		return
+	}
+	h.lastError = err.Error()
+	h.successes = 0
+	h.failures++
+	logger.Debug("Upstream proxy health check failed", "error", err, "failures", h.failures)
+	if !h.down && h.failures >= defaultInt(c.Fall, defaultHealthCheckFall) {
+		h.down = true
+		logger.Warn("Upstream proxy is down", "error", err)
+	}
+}
+
+// probe checks the upstream once according to its health check
+func (u *Upstream) probe(ctx context.Context) error {
+	c := u.HealthCheck
+	ctx, cancel := context.WithTimeout(ctx, defaultDuration(c.Timeout, defaultHealthCheckTimeout))
+	defer cancel()
+	start := time.Now()
+	switch c.Kind {
+	case HealthCheckConnect:
+		conn, err := u.dial(ctx, "tcp", c.Target)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		u.latency.record(proxyName(u), time.Since(start), true)
+		return nil
+	case HealthCheckHTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := u.roundTrip(req)
+		if err != nil {
+			return err
+		}
+		u.latency.record(proxyName(u), time.Since(start), false)
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusProxyAuthRequired {
+			return &UpstreamError{Proxy: u.URL.Redacted(), Status: resp.Status, StatusCode: resp.StatusCode}
+		}
+		return nil
+	default:
+		conn, err := u.dialForward(ctx, "tcp", u.proxyAddr())
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		u.latency.record(proxyName(u), time.Since(start), true)
+		return nil
+	}
+}
+
+// startHealthChecks probes the upstreams having a health check until the returned function is called
+func startHealthChecks(upstreams []*Upstream) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	seen := make(map[*Upstream]bool)
+	for _, u := range upstreams {
+		if u.HealthCheck == nil || seen[u] {
+			continue
+		}
+		seen[u] = true
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			ticker := time.NewTicker(defaultDuration(u.HealthCheck.Interval, defaultHealthCheckInterval))
+			defer ticker.Stop()
+			for {
+				err := u.probe(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				u.recordProbe(err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(u)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
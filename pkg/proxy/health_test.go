@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func TestUpstream_recordProbe(t *testing.T) {
+	u := makeUpstream(t, "http://proxy:8080")
+	u.HealthCheck = &HealthCheck{Rise: 2, Fall: 2}
+	failure := errors.New("connection refused")
+	for i, step := range []struct {
+		err         error
+		wantHealthy bool
+	}{
+		{nil, true},
+		{failure, true},
+		{nil, true},
+		{failure, true},
+		{failure, false},
+		{nil, false},
+		{failure, false},
+		{nil, false},
+		{nil, true},
+	} {
+		u.recordProbe(step.err)
+		status := u.Health()
+		assert.Equal(t, status.Healthy, step.wantHealthy, "step %d", i)
+		assert.Equal(t, u.healthy(), step.wantHealthy, "step %d", i)
+		assert.Assert(t, !status.LastCheck.IsZero())
+		if step.err != nil {
+			assert.Equal(t, status.LastError, step.err.Error())
+		} else {
+			assert.Equal(t, status.LastError, "")
+		}
+	}
+}
+
+func TestUpstream_probe(t *testing.T) {
+	target := newHelloServer(t)
+	working := newFakeUpstream(t, nil)
+	forbidding := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, "authentication required", http.StatusProxyAuthRequired)
+		return false
+	})
+	dead := newDeadUpstream(t)
+	tests := []struct {
+		name    string
+		proxy   string
+		check   HealthCheck
+		wantErr string
+	}{
+		{"TCP", working.URL, HealthCheck{}, ""},
+		{"TCPDead", dead.URL.String(), HealthCheck{Kind: HealthCheckTCP}, "connection refused"},
+		{"Connect", working.URL, HealthCheck{Kind: HealthCheckConnect, Target: target.Listener.Addr().String()}, ""},
+		{"ConnectRefused", forbidding.URL, HealthCheck{Kind: HealthCheckConnect, Target: target.Listener.Addr().String()}, "requires authentication"},
+		{"HTTP", working.URL, HealthCheck{Kind: HealthCheckHTTP, Target: target.URL}, ""},
+		{"HTTPRefused", forbidding.URL, HealthCheck{Kind: HealthCheckHTTP, Target: target.URL}, "requires authentication"},
+		{"HTTPDead", dead.URL.String(), HealthCheck{Kind: HealthCheckHTTP, Target: target.URL}, "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := makeUpstream(t, tt.proxy)
+			u.HealthCheck = &tt.check
+			assert.NilError(t, u.Validate())
+			err := u.probe(context.Background())
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func Test_startHealthChecks(t *testing.T) {
+	working := newFakeUpstream(t, nil)
+	up := makeUpstream(t, working.URL)
+	up.HealthCheck = &HealthCheck{Interval: 10 * time.Millisecond}
+	down := newDeadUpstream(t)
+	down.HealthCheck = &HealthCheck{Interval: 10 * time.Millisecond, Fall: 2}
+	group := NewGroup("corporate", down, up)
+
+	stop := startHealthChecks([]*Upstream{down, up, up})
+	poll.WaitOn(t, func(t poll.LogT) poll.Result {
+		if down.healthy() {
+			return poll.Continue("waiting for the dead proxy to be down")
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	stop()
+
+	assert.Assert(t, up.healthy())
+	assert.Assert(t, !up.Health().LastCheck.IsZero())
+	candidates := group.Group.candidates("")
+	assert.Equal(t, len(candidates), 1, "down members should be skipped")
+	assert.Equal(t, candidates[0], up)
+
+	lastCheck := down.Health().LastCheck
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, down.Health().LastCheck, lastCheck, "health checks should be stopped")
+}
+
+func TestHealthCheck_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		wantErr string
+	}{
+		{"Default", HealthCheck{}, ""},
+		{"Connect", HealthCheck{Kind: HealthCheckConnect, Target: "www.google.com:443"}, ""},
+		{"ConnectWithoutTarget", HealthCheck{Kind: HealthCheckConnect}, "connect health checks require a target"},
+		{"HTTPWithoutTarget", HealthCheck{Kind: HealthCheckHTTP}, "http health checks require a target"},
+		{"UnsupportedKind", HealthCheck{Kind: "icmp"}, `unsupported health check kind "icmp"`},
+		{"NegativeInterval", HealthCheck{Interval: -time.Second}, "can not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.Validate()
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
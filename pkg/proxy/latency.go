@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyWeight is the weight of new samples in latency moving averages
+	latencyWeight = 0.3
+	// latencyMaxAge is the age after which latency measurements are considered stale
+	latencyMaxAge = 5 * time.Minute
+)
+
+// LatencyStatus holds the latency measurements of an upstream
+//
+// Latencies are exponentially weighted moving averages of the time to establish tunnels
+// through the upstream (Connect) and of the time to receive the response headers of plain
+// requests (TTFB), measured from real traffic and health checks.
+type LatencyStatus struct {
+	Connect time.Duration `json:"connect,omitempty"`
+	TTFB    time.Duration `json:"ttfb,omitempty"`
+	// Samples is the number of measurements
+	Samples int `json:"samples"`
+	// LastSample is the time of the last measurement
+	LastSample time.Time `json:"last_sample,omitempty"`
+}
+
+// score returns the latency used to compare upstreams, the mean of the known measurements
+func (s LatencyStatus) score() time.Duration {
+	switch {
+	case s.Connect > 0 && s.TTFB > 0:
+		return (s.Connect + s.TTFB) / 2
+	case s.Connect > 0:
+		return s.Connect
+	default:
+		return s.TTFB
+	}
+}
+
+// fresh returns true if the measurements can be used to compare upstreams
+func (s LatencyStatus) fresh() bool {
+	return s.Samples > 0 && time.Since(s.LastSample) < latencyMaxAge
+}
+
+// latency tracks the latency measurements of an upstream
+type latency struct {
+	mu     sync.Mutex
+	status LatencyStatus
+}
+
+func ewma(average, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(latencyWeight*float64(sample) + (1-latencyWeight)*float64(average))
+}
+
+// Latency returns the latency measurements of the upstream
+func (u *Upstream) Latency() LatencyStatus {
+	return u.latency.get()
+}
+
+func (l *latency) get() LatencyStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status
+}
+
+// record updates the measurements with a sample, connect tells whether it is the time to
+// establish a tunnel or the time to receive the response headers of a plain request
+func (l *latency) record(name string, d time.Duration, connect bool) {
+	l.mu.Lock()
+	if connect {
+		l.status.Connect = ewma(l.status.Connect, d)
+	} else {
+		l.status.TTFB = ewma(l.status.TTFB, d)
+	}
+	l.status.Samples++
+	l.status.LastSample = time.Now()
+	status := l.status
+	l.mu.Unlock()
+	slog.Debug("Upstream proxy latency", "proxy", name, "connect", status.Connect, "ttfb", status.TTFB)
+}
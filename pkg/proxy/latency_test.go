@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_latencyRecord(t *testing.T) {
+	var l latency
+	l.record("proxy", 100*time.Millisecond, true)
+	l.record("proxy", 200*time.Millisecond, true)
+	l.record("proxy", 50*time.Millisecond, false)
+	status := l.get()
+	assert.Equal(t, status.Connect, 130*time.Millisecond)
+	assert.Equal(t, status.TTFB, 50*time.Millisecond)
+	assert.Equal(t, status.Samples, 3)
+	assert.Equal(t, status.score(), 90*time.Millisecond)
+	assert.Assert(t, status.fresh())
+
+	status.LastSample = time.Now().Add(-latencyMaxAge)
+	assert.Assert(t, !status.fresh())
+}
+
+func TestGroup_latencyStrategy(t *testing.T) {
+	fast, slow, unmeasured := makeUpstream(t, "http://fast:8080"), makeUpstream(t, "http://slow:8080"), makeUpstream(t, "http://new:8080")
+	g := &Group{Name: "latency", Members: []*Upstream{slow, fast, nil}, Strategy: Latency}
+	slow.latency.record("slow", 300*time.Millisecond, true)
+	fast.latency.record("fast", 20*time.Millisecond, false)
+	g.direct.record("direct", 100*time.Millisecond, true)
+	candidates := g.candidates("")
+	assert.Equal(t, len(candidates), 3)
+	assert.Equal(t, candidates[0], fast)
+	assert.Assert(t, candidates[1] == nil)
+	assert.Equal(t, candidates[2], slow)
+
+	g.Members = append(g.Members, unmeasured)
+	assert.Equal(t, g.candidates("")[0], unmeasured, "members without measurements should be tried first")
+
+	unmeasured.latency.record("new", time.Second, true)
+	fast.latency.mu.Lock()
+	fast.latency.status.LastSample = time.Now().Add(-latencyMaxAge)
+	fast.latency.mu.Unlock()
+	assert.Equal(t, g.candidates("")[0], fast, "stale measurements should be refreshed")
+}
+
+func TestGroup_latencyMeasurements(t *testing.T) {
+	target := newHelloServer(t)
+	working := newFakeUpstream(t, nil)
+	member := makeUpstream(t, working.URL)
+	group := NewGroup("latency", member, nil)
+	group.Group.Strategy = Latency
+	p := &Profile{Default: group}
+
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+	c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	c.Close()
+	status := member.Latency()
+	assert.Equal(t, status.Samples, 1)
+	assert.Assert(t, status.Connect > 0)
+	assert.Equal(t, status.TTFB, time.Duration(0))
+
+	// the direct member is now tried first as it was never measured
+	c, err = p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	c.Close()
+	assert.Equal(t, group.Group.direct.get().Samples, 1)
+	assert.Equal(t, member.Latency().Samples, 1)
+}
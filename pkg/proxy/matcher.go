@@ -0,0 +1,413 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A target holds the parts of a request that rules are matched against,
+// so they are computed only once per request
+type target struct {
+	req      *http.Request
+	hostname string
+	connect  bool
+
+	// addresses are lazily resolved by IPCIDR rules
+	resolveOnce sync.Once
+	addresses   []netip.Addr
+}
+
+func newTarget(req *http.Request) *target {
+	return &target{
+		req:      req,
+		hostname: stripPort(req.URL),
+		connect:  req.Method == http.MethodConnect,
+	}
+}
+
+// lookupNetIP is the function used to resolve hostnames, it is a variable to allow tests to mock it
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// ip returns the target hostname as an IP address if it is an IP literal
+func (t *target) ip() (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(t.hostname)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// resolve returns the addresses the target hostname resolves to,
+// resolution happens at most once per target
+func (t *target) resolve() []netip.Addr {
+	t.resolveOnce.Do(func() {
+		addrs, err := lookupNetIP(t.req.Context(), "ip", t.hostname)
+		if err != nil {
+			slog.Debug("failed to resolve hostname", "hostname", t.hostname, "error", err)
+			return
+		}
+		for _, a := range addrs {
+			t.addresses = append(t.addresses, a.Unmap())
+		}
+	})
+	return t.addresses
+}
+
+// A compiledRule is a Rule ready to be matched against a target
+type compiledRule interface {
+	match(t *target) bool
+	// hostPattern returns the wildcard the target hostname should match for this rule,
+	// it is used to index rules. An empty wildcard means that the rule can't be indexed by hostname.
+	hostPattern() wildcard
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	switch r.Kind {
+	case HostWildcard:
+		return hostWildcardRule{newWildcard(r.Pattern)}, nil
+	case URLPattern:
+		return parseURLPattern(r.Pattern), nil
+	case IPCIDR:
+		return parseIPRange(r.Pattern, r.Resolve)
+	case HostRegex:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", r.Pattern, err)
+		}
+		return hostRegexRule{re}, nil
+	default:
+		return nil, fmt.Errorf("unsupported rule kind %d for pattern %q", r.Kind, r.Pattern)
+	}
+}
+
+// A wildcard is a pattern where '*' stands for any sequence of characters.
+// It is stored split around its stars.
+type wildcard []string
+
+func newWildcard(pattern string) wildcard {
+	if pattern == "" {
+		return nil
+	}
+	return strings.Split(pattern, "*")
+}
+
+func (w wildcard) match(s string) bool {
+	if len(w) == 0 {
+		return true
+	}
+	if len(w) == 1 {
+		return s == w[0]
+	}
+	if !strings.HasPrefix(s, w[0]) {
+		return false
+	}
+	s = s[len(w[0]):]
+	for _, part := range w[1 : len(w)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, w[len(w)-1])
+}
+
+// exact returns the literal matched by the wildcard if it contains no star
+func (w wildcard) exact() (string, bool) {
+	if len(w) != 1 {
+		return "", false
+	}
+	return w[0], true
+}
+
+// domainSuffix returns the domain of "*.domain" wildcards
+func (w wildcard) domainSuffix() (string, bool) {
+	if len(w) != 2 || w[0] != "" || !strings.HasPrefix(w[1], ".") || len(w[1]) == 1 {
+		return "", false
+	}
+	return w[1][1:], true
+}
+
+type hostWildcardRule struct {
+	host wildcard
+}
+
+func (r hostWildcardRule) match(t *target) bool {
+	return r.host.match(t.hostname)
+}
+
+func (r hostWildcardRule) hostPattern() wildcard {
+	return r.host
+}
+
+type hostRegexRule struct {
+	re *regexp.Regexp
+}
+
+func (r hostRegexRule) match(t *target) bool {
+	return r.re.MatchString(t.hostname)
+}
+
+func (r hostRegexRule) hostPattern() wildcard {
+	return nil
+}
+
+// urlPattern is the decomposition of an URLPattern rule, empty parts match everything
+type urlPattern struct {
+	scheme wildcard
+	host   wildcard
+	port   wildcard
+	path   wildcard
+}
+
+func parseURLPattern(pattern string) urlPattern {
+	var up urlPattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		up.scheme = newWildcard(strings.ToLower(pattern[:i]))
+		pattern = pattern[i+3:]
+	}
+	if i := strings.IndexByte(pattern, '/'); i >= 0 {
+		up.path = newWildcard(pattern[i:])
+		pattern = pattern[:i]
+	}
+	host := pattern
+	if strings.HasPrefix(pattern, "[") {
+		// IPv6 literal
+		if i := strings.IndexByte(pattern, ']'); i >= 0 {
+			host = pattern[1:i]
+			up.port = newWildcard(strings.TrimPrefix(pattern[i+1:], ":"))
+		}
+	} else if i := strings.LastIndexByte(pattern, ':'); i >= 0 {
+		host = pattern[:i]
+		up.port = newWildcard(pattern[i+1:])
+	}
+	up.host = newWildcard(host)
+	return up
+}
+
+func (up urlPattern) match(t *target) bool {
+	if !up.host.match(t.hostname) {
+		return false
+	}
+	if t.connect {
+		return true
+	}
+	return up.scheme.match(strings.ToLower(t.req.URL.Scheme)) &&
+		up.port.match(urlPort(t.req.URL)) &&
+		up.path.match(t.req.URL.Path)
+}
+
+func (up urlPattern) hostPattern() wildcard {
+	return up.host
+}
+
+// An ipRangeRule matches addresses between first and last inclusive
+type ipRangeRule struct {
+	first   netip.Addr
+	last    netip.Addr
+	resolve bool
+}
+
+func parseIPRange(pattern string, resolve bool) (ipRangeRule, error) {
+	r := ipRangeRule{resolve: resolve}
+	if strings.Contains(pattern, "/") {
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return r, fmt.Errorf("invalid CIDR block %q: %w", pattern, err)
+		}
+		prefix = prefix.Masked()
+		r.first = prefix.Addr().Unmap()
+		r.last = lastAddr(prefix)
+		return r, nil
+	}
+	first, last, isRange := strings.Cut(pattern, "-")
+	var err error
+	r.first, err = netip.ParseAddr(strings.TrimSpace(first))
+	if err != nil {
+		return r, fmt.Errorf("invalid IP address in %q: %w", pattern, err)
+	}
+	r.first = r.first.Unmap()
+	r.last = r.first
+	if isRange {
+		r.last, err = netip.ParseAddr(strings.TrimSpace(last))
+		if err != nil {
+			return r, fmt.Errorf("invalid IP address in %q: %w", pattern, err)
+		}
+		r.last = r.last.Unmap()
+		if r.first.Is4() != r.last.Is4() || r.last.Less(r.first) {
+			return r, fmt.Errorf("invalid IP range %q", pattern)
+		}
+	}
+	return r, nil
+}
+
+// lastAddr returns the last address of a masked prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().Unmap().AsSlice()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4In6() {
+		bits -= 96
+	}
+	for i := range b {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			b[i] |= 0xff >> bits
+			bits = 0
+		default:
+			b[i] = 0xff
+		}
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (r ipRangeRule) contains(addr netip.Addr) bool {
+	return r.first.BitLen() == addr.BitLen() && !addr.Less(r.first) && !r.last.Less(addr)
+}
+
+func (r ipRangeRule) match(t *target) bool {
+	if addr, ok := t.ip(); ok {
+		return r.contains(addr)
+	}
+	if !r.resolve {
+		return false
+	}
+	for _, addr := range t.resolve() {
+		if r.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ipRangeRule) hostPattern() wildcard {
+	return nil
+}
+
+// urlPort returns the URL port or the default port of its scheme
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
+
+// A matcher finds the first rule of a profile matching a target.
+//
+// Rules are indexed by hostname: rules for an exact hostname are stored in a map,
+// rules for a "*.domain" wildcard are stored in a trie of reversed domain labels and
+// remaining rules are checked sequentially. The rule with the lowest index among all
+// matching candidates wins, so the rules order is preserved.
+type matcher struct {
+	rules    []compiledRule
+	exact    map[string][]int
+	suffixes *suffixNode
+	others   []int
+}
+
+func compileRules(rules []Rule) (*matcher, error) {
+	m := &matcher{
+		exact:    make(map[string][]int),
+		suffixes: &suffixNode{},
+	}
+	for i, r := range rules {
+		cr, err := compileRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d: %w", i, err)
+		}
+		m.rules = append(m.rules, cr)
+		host := cr.hostPattern()
+		if h, ok := host.exact(); ok {
+			m.exact[h] = append(m.exact[h], i)
+		} else if d, ok := host.domainSuffix(); ok {
+			m.suffixes.insert(d, i)
+		} else {
+			m.others = append(m.others, i)
+		}
+	}
+	return m, nil
+}
+
+// find returns the index of the first matching rule or -1 if none matches
+func (m *matcher) find(t *target) int {
+	var buf [16]int
+	candidates := append(buf[:0], m.exact[t.hostname]...)
+	candidates = m.suffixes.collect(t.hostname, candidates)
+	sort.Ints(candidates)
+
+	// merge indexed candidates and other rules in rules order
+	var i, j int
+	for i < len(candidates) || j < len(m.others) {
+		var idx int
+		if j >= len(m.others) || (i < len(candidates) && candidates[i] < m.others[j]) {
+			idx = candidates[i]
+			i++
+		} else {
+			idx = m.others[j]
+			j++
+		}
+		if m.rules[idx].match(t) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// A suffixNode is a node of a trie of reversed domain labels
+type suffixNode struct {
+	children map[string]*suffixNode
+	// rules holds the indexes of "*.domain" rules for the domain ending at this node
+	rules []int
+}
+
+func (n *suffixNode) insert(domain string, rule int) {
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if n.children == nil {
+			n.children = make(map[string]*suffixNode)
+		}
+		child, ok := n.children[labels[i]]
+		if !ok {
+			child = &suffixNode{}
+			n.children[labels[i]] = child
+		}
+		n = child
+	}
+	n.rules = append(n.rules, rule)
+}
+
+// collect appends to rules the indexes of the "*.domain" rules matching the hostname
+func (n *suffixNode) collect(hostname string, rules []int) []int {
+	rest := hostname
+	for rest != "" {
+		var label string
+		if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+			label, rest = rest[i+1:], rest[:i]
+		} else {
+			// the first label has no remaining label to be matched by the star
+			return rules
+		}
+		n = n.children[label]
+		if n == nil {
+			return rules
+		}
+		rules = append(rules, n.rules...)
+	}
+	return rules
+}
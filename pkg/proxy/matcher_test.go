@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func Test_wildcard_match(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"", "anything", true},
+		{"gist.github.com", "gist.github.com", true},
+		{"gist.github.com", "gistXgithub.com", false},
+		{"*.google.com", "www.google.com", true},
+		{"*.google.com", "google.com", false},
+		{"*google.com", "google.com", true},
+		{"*.google.*", "www.google.fr", true},
+		{"*.google.*", "www.google", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYc", true},
+		{"a*b*c", "aXcYb", false},
+		{"a*a", "a", false},
+		{"*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"_"+tt.s, func(t *testing.T) {
+			assert.Equal(t, newWildcard(tt.pattern).match(tt.s), tt.want)
+		})
+	}
+}
+
+func Test_matcher_find(t *testing.T) {
+	rules := []Rule{
+		{Pattern: "*.google.*"},
+		{Pattern: "*.mail.google.com"},
+		{Pattern: "www.google.com"},
+		{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/public/*"},
+		{Pattern: "*.yourcompany.it"},
+		{Pattern: "*.google.com"},
+		{Pattern: "*.com"},
+	}
+	m, err := compileRules(rules)
+	assert.NilError(t, err)
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"http://www.google.com", 0},
+		{"http://inbox.mail.google.com", 0},
+		{"http://google.com", 6},
+		{"http://repo.yourcompany.it/public/lib.jar", 3},
+		{"http://repo.yourcompany.it/private/lib.jar", 4},
+		{"http://yourcompany.it", -1},
+		{"http://somewhere.else", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			assert.Equal(t, m.find(newTarget(&http.Request{URL: makeURL(t, tt.url)})), tt.want)
+		})
+	}
+}
+
+// chooseProxyRegexp is the original implementation of Profile.chooseProxy
+// it is used as a reference for benchmarks
+func chooseProxyRegexp(p *Profile, req *http.Request) *Upstream {
+	for _, r := range p.Rules {
+		hostname := stripPort(req.URL)
+		rePattern := strings.Replace(r.Pattern, ".", `\.`, -1)
+		rePattern = strings.Replace(rePattern, "*", ".*", -1)
+		rePattern = "^" + rePattern + "$"
+		if ok, err := regexp.MatchString(rePattern, hostname); err == nil && ok {
+			return r.Proxy
+		}
+	}
+	return p.Default
+}
+
+func benchmarkProfile(b *testing.B, nbRules int) (*Profile, []*http.Request) {
+	proxyURL, _ := url.Parse("http://myproxy.mycomp.it:8080")
+	upstream := NewUpstream(proxyURL)
+	rules := make([]Rule, 0, nbRules)
+	for i := 0; i < nbRules; i++ {
+		switch i % 3 {
+		case 0:
+			rules = append(rules, Rule{Pattern: fmt.Sprintf("host%d.mycomp.it", i), Proxy: upstream})
+		case 1:
+			rules = append(rules, Rule{Pattern: fmt.Sprintf("*.domain%d.com", i), Proxy: upstream})
+		default:
+			rules = append(rules, Rule{Pattern: fmt.Sprintf("*.site%d.*", i), Proxy: upstream})
+		}
+	}
+	p, err := NewProfile(nil, rules)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// a "*.site%d.*" rule in the middle of the profile
+	middle := nbRules/2 - nbRules/2%3 + 2
+	var reqs []*http.Request
+	for _, u := range []string{
+		"http://host0.mycomp.it",
+		fmt.Sprintf("http://www.domain%d.com/index.html", nbRules-2-(nbRules-2)%3+1),
+		fmt.Sprintf("http://www.site%d.org", middle),
+		"http://somewhere.else",
+	} {
+		reqURL, _ := url.Parse(u)
+		reqs = append(reqs, &http.Request{URL: reqURL})
+	}
+	return p, reqs
+}
+
+func BenchmarkProfile_chooseProxy(b *testing.B) {
+	for _, nbRules := range []int{10, 100, 500} {
+		p, reqs := benchmarkProfile(b, nbRules)
+		b.Run(fmt.Sprintf("compiled_%d_rules", nbRules), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = p.chooseProxy(reqs[i%len(reqs)])
+			}
+		})
+		b.Run(fmt.Sprintf("regexp_%d_rules", nbRules), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_ = chooseProxyRegexp(p, reqs[i%len(reqs)])
+			}
+		})
+	}
+}
+
+func Test_ipRangeRule_match(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = orig }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		switch host {
+		case "intranet.yourcompany.it":
+			return []netip.Addr{netip.MustParseAddr("10.12.1.2")}, nil
+		case "v6.yourcompany.it":
+			return []netip.Addr{netip.MustParseAddr("2001:db8::1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		pattern string
+		resolve bool
+		url     string
+		want    bool
+		wantErr bool
+	}{
+		{"10.12.0.0/16", false, "http://10.12.200.3:8080/", true, false},
+		{"10.12.0.0/16", false, "http://10.13.0.1/", false, false},
+		{"10.12.3.4/16", false, "http://10.12.0.0/", true, false},
+		{"192.168.0.0/16", false, "http://[::ffff:192.168.1.1]/", true, false},
+		{"2001:db8::/32", false, "http://[2001:db8:1::1]:8080/", true, false},
+		{"2001:db8::/32", false, "http://10.12.0.1/", false, false},
+		{"10.0.0.1-10.0.0.20", false, "http://10.0.0.20/", true, false},
+		{"10.0.0.1-10.0.0.20", false, "http://10.0.0.21/", false, false},
+		{"10.0.0.1", false, "http://10.0.0.1/", true, false},
+		{"10.12.0.0/16", false, "http://intranet.yourcompany.it/", false, false},
+		{"10.12.0.0/16", true, "http://intranet.yourcompany.it/", true, false},
+		{"10.12.0.0/16", true, "http://v6.yourcompany.it/", false, false},
+		{"10.12.0.0/16", true, "http://unknown.yourcompany.it/", false, false},
+		{"10.12.0.0/33", false, "", false, true},
+		{"10.0.0.20-10.0.0.1", false, "", false, true},
+		{"10.0.0.1-2001:db8::1", false, "", false, true},
+		{"not an ip", false, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"_"+tt.url, func(t *testing.T) {
+			r, err := compileRule(Rule{Kind: IPCIDR, Pattern: tt.pattern, Resolve: tt.resolve})
+			if tt.wantErr {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, r.match(newTarget(&http.Request{URL: makeURL(t, tt.url)})), tt.want)
+		})
+	}
+}
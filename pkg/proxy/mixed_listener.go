@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// protocolDetectionTimeout closes connections sending no data for that long. It is well above
+// socksHandshakeTimeout as browsers open HTTP connections ahead of their requests and may keep them
+// idle for minutes, which the HTTP server, having no timeouts, accepts. Tests may lower it.
+var protocolDetectionTimeout = 5 * time.Minute
+
+// mixedListener serves SOCKS4 and SOCKS5 clients of a listener and hands the other connections,
+// expected to be HTTP ones, to the caller of Accept. The protocol is detected from the first byte
+// sent by the client: no HTTP request starts with a SOCKS version.
+type mixedListener struct {
+	net.Listener
+	proxy *proxy
+	// detectionTimeout is protocolDetectionTimeout when the listener was created
+	detectionTimeout time.Duration
+	accepted         chan acceptResult
+	closed           chan struct{}
+	close            sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// listenMixed starts detecting the protocol of the connections accepted on l
+func (p *proxy) listenMixed(l net.Listener) net.Listener {
+	ml := &mixedListener{
+		Listener:         l,
+		proxy:            p,
+		detectionTimeout: protocolDetectionTimeout,
+		accepted:         make(chan acceptResult),
+		closed:           make(chan struct{}),
+	}
+	go ml.acceptLoop()
+	return ml
+}
+
+func (l *mixedListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			// errors are forwarded so that the HTTP server decides to retry or to stop
+			select {
+			case l.accepted <- acceptResult{err: err}:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		// detection waits for the client, it should not delay the next connections
+		go l.dispatch(c)
+	}
+}
+
+// dispatch reads the first byte of c to serve it as a SOCKS client or to return it from Accept
+func (l *mixedListener) dispatch(c net.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(l.detectionTimeout))
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(c, first); err != nil {
+		slog.Debug("Closing connection sending no data", "client", c.RemoteAddr(), "error", err)
+		c.Close()
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	sc := &sniffedConn{Conn: c, sniffed: first}
+	switch first[0] {
+	case socks4Version, socks5Version:
+		l.proxy.handleSocks(sc)
+	default:
+		select {
+		case l.accepted <- acceptResult{conn: sc}:
+		case <-l.closed:
+			c.Close()
+		}
+	}
+}
+
+// Accept waits for the next connection which is not a SOCKS one
+func (l *mixedListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.accepted:
+		return r.conn, r.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections, SOCKS clients already served are not closed
+func (l *mixedListener) Close() error {
+	l.close.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// sniffedConn is a connection whose first bytes were read to detect its protocol, they are returned again
+// by the first reads
+type sniffedConn struct {
+	net.Conn
+	sniffed []byte
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if len(c.sniffed) > 0 {
+		n := copy(b, c.sniffed)
+		c.sniffed = c.sniffed[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// WriteTo lets io.Copy use the optimizations of the underlying connection, like splice for TCP
+func (c *sniffedConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if len(c.sniffed) > 0 {
+		n, err := w.Write(c.sniffed)
+		written, c.sniffed = int64(n), c.sniffed[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err := io.Copy(w, c.Conn)
+	return written + n, err
+}
+
+// ReadFrom lets io.Copy use the optimizations of the underlying connection, like splice for TCP
+func (c *sniffedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
+
+// CloseRead lets tunnels half close sniffed TCP connections
+func (c *sniffedConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfClosableConn); ok {
+		return hc.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+// CloseWrite lets tunnels half close sniffed TCP connections
+func (c *sniffedConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfClosableConn); ok {
+		return hc.CloseWrite()
+	}
+	return c.Conn.Close()
+}
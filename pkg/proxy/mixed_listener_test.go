@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+	"gotest.tools/v3/assert"
+)
+
+func Test_proxyMixedListener(t *testing.T) {
+	target := newHelloServer(t)
+	p := newProxy()
+	profile, err := NewProfile(nil, nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	ml := p.listenMixed(l)
+	defer ml.Close()
+	go func() { _ = http.Serve(ml, p) }()
+	proxyAddr := l.Addr().String()
+
+	// a client sending nothing should not prevent the others from being served
+	silent, err := net.Dial("tcp", proxyAddr)
+	assert.NilError(t, err)
+	defer silent.Close()
+
+	tests := []struct {
+		name string
+		get  func(t *testing.T) string
+	}{
+		{"HTTP", func(t *testing.T) string {
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: proxyAddr})}}
+			resp, err := client.Get(target.URL)
+			assert.NilError(t, err)
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			assert.NilError(t, err)
+			return string(b)
+		}},
+		{"CONNECT", func(t *testing.T) string {
+			c, err := net.Dial("tcp", proxyAddr)
+			assert.NilError(t, err)
+			fmt.Fprintf(c, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target.Listener.Addr())
+			resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+			assert.NilError(t, err)
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			return getThroughTunnel(t, c, target.URL)
+		}},
+		{"SOCKS5", func(t *testing.T) string {
+			d, err := xproxy.SOCKS5("tcp", proxyAddr, nil, xproxy.Direct)
+			assert.NilError(t, err)
+			c, err := d.Dial("tcp", target.Listener.Addr().String())
+			assert.NilError(t, err)
+			return getThroughTunnel(t, c, target.URL)
+		}},
+		{"SOCKS4", func(t *testing.T) string {
+			c, err := makeUpstream(t, "socks4://"+proxyAddr).dial(context.Background(), "tcp", target.Listener.Addr().String())
+			assert.NilError(t, err)
+			return getThroughTunnel(t, c, target.URL)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.get(t), "hello")
+		})
+	}
+}
+
+func Test_proxyMixedListenerIdleClients(t *testing.T) {
+	defer func(orig time.Duration) { protocolDetectionTimeout = orig }(protocolDetectionTimeout)
+	protocolDetectionTimeout = 500 * time.Millisecond
+	target := newHelloServer(t)
+	p := newProxy()
+	profile, err := NewProfile(nil, nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	ml := p.listenMixed(l)
+	defer ml.Close()
+	go func() { _ = http.Serve(ml, p) }()
+
+	preconnected, err := net.Dial("tcp", l.Addr().String())
+	assert.NilError(t, err)
+	defer preconnected.Close()
+	silent, err := net.Dial("tcp", l.Addr().String())
+	assert.NilError(t, err)
+	defer silent.Close()
+	assert.NilError(t, silent.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// a connection opened ahead of its request is served once the request comes
+	time.Sleep(200 * time.Millisecond)
+	fmt.Fprintf(preconnected, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", target.URL, target.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(preconnected), nil)
+	assert.NilError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "hello")
+
+	// connections sending nothing are closed after protocolDetectionTimeout
+	_, err = silent.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+}
@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+//go:embed pac_utils.js
+var pacUtils string
+
+// defaultPACRefresh is the RefreshInterval of PAC scripts loaded with LoadPAC
+const defaultPACRefresh = time.Hour
+
+// pacEvalTimeout interrupts scripts running for too long and pacDNSTimeout limits their DNS lookups,
+// tests may lower them
+var (
+	pacEvalTimeout = 5 * time.Second
+	pacDNSTimeout  = 2 * time.Second
+)
+
+// A PAC is a compiled Proxy Auto-Configuration script
+//
+// The embedded JavaScript engine is not safe for concurrent use so evaluations are serialized.
+type PAC struct {
+	// Location is the file path or URL the script was loaded from
+	Location string
+	// Script is the source code of the script, it is replaced when the script is refreshed
+	Script string
+	// RefreshInterval is how often the script is loaded again from Location, zero or less disables refreshes.
+	// Refreshes happen in the background of evaluations, the current script is kept if they fail.
+	RefreshInterval time.Duration
+
+	mu        sync.Mutex
+	vm        *goja.Runtime
+	findProxy goja.Callable
+	// loadedAt is the time the script was last loaded or tried to be, in Unix nanoseconds
+	loadedAt   atomic.Int64
+	refreshing atomic.Bool
+	// upstreams caches the proxies chosen by the script by URL, and the groups of their fallbacks by result
+	upstreams sync.Map
+}
+
+// pacClient is used to download PAC files, it connects directly to the PAC server as
+// sweetcher may be configured as the system proxy and not be started yet.
+var pacClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+	Timeout:   30 * time.Second,
+}
+
+// LoadPAC reads a PAC script from a local file path or from an http(s) URL and compiles it
+func LoadPAC(ctx context.Context, location string) (*PAC, error) {
+	var script []byte
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		script, err = downloadPAC(ctx, location)
+	} else {
+		script, err = os.ReadFile(strings.TrimPrefix(location, "file://"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PAC file %q: %w", location, err)
+	}
+	pac, err := NewPAC(string(script))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load PAC file %q: %w", location, err)
+	}
+	pac.Location = location
+	pac.RefreshInterval = defaultPACRefresh
+	return pac, nil
+}
+
+func downloadPAC(ctx context.Context, location string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := pacClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %q", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// NewPAC compiles a PAC script, the script should define a FindProxyForURL(url, host) function
+func NewPAC(script string) (*PAC, error) {
+	vm := goja.New()
+	for name, fn := range map[string]interface{}{
+		"dnsResolve":  pacDNSResolve,
+		"myIpAddress": pacMyIPAddress,
+		"alert":       pacAlert,
+	} {
+		if err := vm.Set(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := vm.RunString(pacUtils); err != nil {
+		return nil, fmt.Errorf("failed to load PAC helper functions: %w", err)
+	}
+	err := runWithTimeout(vm, func() error {
+		_, err := vm.RunString(script)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate PAC script: %w", err)
+	}
+	findProxy, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	if !ok {
+		return nil, fmt.Errorf("PAC script does not define a FindProxyForURL function")
+	}
+	pac := &PAC{Script: script, vm: vm, findProxy: findProxy}
+	pac.loadedAt.Store(time.Now().UnixNano())
+	return pac, nil
+}
+
+// runWithTimeout runs JavaScript code, interrupting it after pacEvalTimeout
+func runWithTimeout(vm *goja.Runtime, run func() error) error {
+	interrupted := make(chan struct{})
+	timer := time.AfterFunc(pacEvalTimeout, func() {
+		vm.Interrupt(fmt.Errorf("PAC evaluation timed out after %s", pacEvalTimeout))
+		close(interrupted)
+	})
+	err := run()
+	if !timer.Stop() {
+		// the interruption may not have been noticed, it should not affect the next evaluation
+		<-interrupted
+		vm.ClearInterrupt()
+	}
+	return err
+}
+
+// FindProxy calls the FindProxyForURL function of the script
+// and returns the raw result (ie. "PROXY proxy.yourcompany.it:8080; DIRECT")
+func (p *PAC) FindProxy(rawURL, host string) (string, error) {
+	p.refreshIfStale()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var v goja.Value
+	err := runWithTimeout(p.vm, func() error {
+		var err error
+		v, err = p.findProxy(goja.Undefined(), p.vm.ToValue(rawURL), p.vm.ToValue(host))
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate FindProxyForURL(%q, %q): %w", rawURL, host, err)
+	}
+	return v.String(), nil
+}
+
+// source returns the current source code of the script
+func (p *PAC) source() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Script
+}
+
+// refreshIfStale loads the script again in the background once RefreshInterval elapsed since it was loaded
+func (p *PAC) refreshIfStale() {
+	if p.RefreshInterval <= 0 || p.Location == "" {
+		return
+	}
+	if time.Since(time.Unix(0, p.loadedAt.Load())) < p.RefreshInterval || !p.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.refreshing.Store(false)
+		fresh, err := LoadPAC(context.Background(), p.Location)
+		// failures are retried after another interval rather than on each evaluation
+		p.loadedAt.Store(time.Now().UnixNano())
+		if err != nil {
+			slog.Warn("Failed to refresh PAC file, keeping the current one", "location", p.Location, "error", err)
+			return
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if fresh.Script != p.Script {
+			slog.Info("PAC file changed", "location", p.Location)
+		}
+		p.Script, p.vm, p.findProxy = fresh.Script, fresh.vm, fresh.findProxy
+	}()
+}
+
+// chooseProxy evaluates the PAC script for the given request and returns the proxy of the result,
+// nil means DIRECT. Results listing several entries are used as failover groups.
+func (p *PAC) chooseProxy(req *http.Request) (*Upstream, error) {
+	rawURL := req.URL.String()
+	if req.Method == http.MethodConnect {
+		// like browsers do, only expose the scheme and host of tunneled requests
+		rawURL = "https://" + stripPort(req.URL) + "/"
+	}
+	result, err := p.FindProxy(rawURL, stripPort(req.URL))
+	if err != nil {
+		return nil, err
+	}
+	proxies, err := parsePACResult(result)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) == 1 {
+		return p.upstream(proxies[0]), nil
+	}
+	name := strings.Join(strings.Fields(result), " ")
+	if g, ok := p.upstreams.Load("group:" + name); ok {
+		return g.(*Upstream), nil
+	}
+	members := make([]*Upstream, 0, len(proxies))
+	for _, proxy := range proxies {
+		members = append(members, p.upstream(proxy))
+	}
+	g, _ := p.upstreams.LoadOrStore("group:"+name, NewGroup(name, members...))
+	return g.(*Upstream), nil
+}
+
+// upstream returns the Upstream of a proxy chosen by the script, upstreams are reused
+// so connections to the same proxy can be reused as well
+func (p *PAC) upstream(proxy *url.URL) *Upstream {
+	if proxy == nil {
+		return nil
+	}
+	u, _ := p.upstreams.LoadOrStore(proxy.String(), NewUpstream(proxy))
+	return u.(*Upstream)
+}
+
+// parsePACResult converts a FindProxyForURL result into a list of proxy URLs,
+// nil entries mean DIRECT
+func parsePACResult(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(fields[0])
+		if kind == "DIRECT" {
+			proxies = append(proxies, nil)
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed PAC result entry %q", entry)
+		}
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		case "SOCKS4":
+			scheme = "socks4"
+		default:
+			return nil, fmt.Errorf("unsupported PAC result entry %q", entry)
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: fields[1]})
+	}
+	if len(proxies) == 0 {
+		// An empty result is the same as DIRECT
+		proxies = append(proxies, nil)
+	}
+	return proxies, nil
+}
+
+func pacDNSResolve(host string) interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), pacDNSTimeout)
+	defer cancel()
+	addrs, err := lookupNetIP(ctx, "ip4", host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0].String()
+}
+
+func pacMyIPAddress() string {
+	// No packet is sent, this only selects the interface used for outbound traffic
+	c, err := net.Dial("udp", "198.51.100.1:53")
+	if err != nil {
+		return "127.0.0.1"
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func pacAlert(msg string) {
+	slog.Info("PAC alert", "message", msg)
+}
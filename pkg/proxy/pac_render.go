@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A PACMode defines where the PAC script served by Sweetcher points clients to
+type PACMode string
+
+const (
+	// PACModeSelf PAC scripts point clients to Sweetcher itself for proxied requests
+	// and let them connect directly for requests matching a direct rule.
+	// This is the default mode.
+	PACModeSelf PACMode = "self"
+	// PACModeUpstream PAC scripts point clients directly to the upstream proxies
+	PACModeUpstream PACMode = "upstream"
+)
+
+// pacSelfVar is the name of the variable holding the PAC directive to reach Sweetcher itself,
+// it is defined when serving the script as it depends on the address used by the client.
+const pacSelfVar = "sweetcher"
+
+// pacHelpers are functions used by generated PAC scripts to match rules
+const pacHelpers = `function sweetcherMatchURL(url, host, hostPattern, schemePattern, portPattern, pathPattern) {
+  if (!shExpMatch(host, hostPattern)) {
+    return false;
+  }
+  var m = /^([^:]+):\/\/(\[[^\]]*\]|[^\/:?#]*)(?::(\d+))?([^?#]*)/.exec(url);
+  if (m == null) {
+    return true;
+  }
+  var scheme = m[1].toLowerCase();
+  if (scheme == "https") {
+    // like for CONNECT requests only the host is known
+    return true;
+  }
+  var port = m[3] || (scheme == "http" ? "80" : "");
+  return shExpMatch(scheme, schemePattern) && shExpMatch(port, portPattern) && shExpMatch(m[4] || "/", pathPattern);
+}
+
+function sweetcherInRange(host, first, last, resolve) {
+  var ip = host;
+  if (!/^\d{1,3}(\.\d{1,3}){3}$/.test(ip)) {
+    if (!resolve) {
+      return false;
+    }
+    ip = dnsResolve(host);
+    if (ip == null) {
+      return false;
+    }
+  }
+  var addr = convert_addr(ip) >>> 0;
+  return addr >= (convert_addr(first) >>> 0) && addr <= (convert_addr(last) >>> 0);
+}
+`
+
+// renderPAC generates a PAC script from the profile rules and default proxy
+func (p *Profile) renderPAC(mode PACMode) (string, error) {
+	if err := p.compile(); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString("// Generated by Sweetcher from the active profile\n\n")
+	sb.WriteString(pacHelpers)
+	if p.PAC != nil && mode == PACModeUpstream {
+		fmt.Fprintf(&sb, "\n// PAC file loaded from %s\nvar sweetcherPAC = (function () {\n%s\nreturn FindProxyForURL;\n})();\n", p.PAC.Location, p.PAC.source())
+	}
+	sb.WriteString("\nfunction FindProxyForURL(url, host) {\n")
+	for i, r := range p.Rules {
+		cond, err := pacCondition(p.matcher.rules[i])
+		if err != nil {
+			slog.Warn("Rule can't be expressed in the PAC script, PAC clients will ignore it", "rule", i, "pattern", r.Pattern, "error", err)
+			fmt.Fprintf(&sb, "  // rule #%d %q can't be expressed in a PAC script: %s\n", i, r.Pattern, strings.ReplaceAll(err.Error(), "\n", " "))
+			continue
+		}
+		fmt.Fprintf(&sb, "  if (%s) {\n    return %s;\n  }\n", cond, pacDirective(r.Proxy, mode))
+	}
+	switch {
+	case p.PAC != nil && mode == PACModeUpstream:
+		sb.WriteString("  return sweetcherPAC(url, host);\n")
+	case p.PAC != nil:
+		sb.WriteString("  return " + pacSelfVar + ";\n")
+	default:
+		fmt.Fprintf(&sb, "  return %s;\n", pacDirective(p.Default, mode))
+	}
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+// pacCondition returns the JavaScript expression matching a rule
+func pacCondition(r compiledRule) (string, error) {
+	switch cr := r.(type) {
+	case hostWildcardRule:
+		return fmt.Sprintf("shExpMatch(host, %s)", jsString(cr.host.String())), nil
+	case urlPattern:
+		return fmt.Sprintf("sweetcherMatchURL(url, host, %s, %s, %s, %s)",
+			jsString(cr.host.String()), jsString(cr.scheme.String()), jsString(cr.port.String()), jsString(cr.path.String())), nil
+	case ipRangeRule:
+		if !cr.first.Is4() {
+			return "", errors.New("PAC scripts only support IPv4 addresses")
+		}
+		return fmt.Sprintf("sweetcherInRange(host, %s, %s, %t)", jsString(cr.first.String()), jsString(cr.last.String()), cr.resolve), nil
+	case hostRegexRule:
+		source, err := jsRegExp(cr.re.String())
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("new RegExp(%s).test(host)", jsString(source)), nil
+	}
+	return "", fmt.Errorf("unsupported rule %T", r)
+}
+
+// jsRegExp translates a Go regular expression to the source of a JavaScript RegExp matching the same strings.
+//
+// The source is generated from the parsed expression as RE2 syntax like (?i), (?P<name>) or \z
+// is not valid in JavaScript. It fails for line anchors of multi-line mode and for characters
+// outside of the Basic Multilingual Plane in classes, which RegExp can only express with flags.
+func jsRegExp(expr string) (string, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	if err := writeJSRegExp(&sb, re); err != nil {
+		return "", fmt.Errorf("regular expression %q can't be translated to JavaScript: %w", expr, err)
+	}
+	return sb.String(), nil
+}
+
+func writeJSRegExp(sb *strings.Builder, re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		sb.WriteString(`[^\s\S]`)
+	case syntax.OpEmptyMatch:
+		sb.WriteString("(?:)")
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if re.Flags&syntax.FoldCase != 0 && unicode.SimpleFold(r) != r {
+				// JavaScript has no inline flags, each letter matches its case variants
+				folds := []rune{r}
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					folds = append(folds, f)
+				}
+				if err := writeJSClass(sb, false, runePairs(folds)); err != nil {
+					return err
+				}
+				continue
+			}
+			writeJSRune(sb, r)
+		}
+	case syntax.OpCharClass:
+		return writeJSCharClass(sb, re.Rune)
+	case syntax.OpAnyCharNotNL:
+		sb.WriteString(`[^\n]`)
+	case syntax.OpAnyChar:
+		sb.WriteString(`[\s\S]`)
+	case syntax.OpBeginText:
+		sb.WriteString("^")
+	case syntax.OpEndText:
+		sb.WriteString("$")
+	case syntax.OpWordBoundary:
+		sb.WriteString(`\b`)
+	case syntax.OpNoWordBoundary:
+		sb.WriteString(`\B`)
+	case syntax.OpCapture:
+		sb.WriteString("(")
+		if err := writeJSRegExp(sb, re.Sub[0]); err != nil {
+			return err
+		}
+		sb.WriteString(")")
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		if err := writeJSAtom(sb, re.Sub[0]); err != nil {
+			return err
+		}
+		switch re.Op {
+		case syntax.OpStar:
+			sb.WriteString("*")
+		case syntax.OpPlus:
+			sb.WriteString("+")
+		case syntax.OpQuest:
+			sb.WriteString("?")
+		case syntax.OpRepeat:
+			sb.WriteString("{" + strconv.Itoa(re.Min))
+			if re.Max != re.Min {
+				sb.WriteString(",")
+				if re.Max >= 0 {
+					sb.WriteString(strconv.Itoa(re.Max))
+				}
+			}
+			sb.WriteString("}")
+		}
+		if re.Flags&syntax.NonGreedy != 0 {
+			sb.WriteString("?")
+		}
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := writeJSRegExp(sb, sub); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		sb.WriteString("(?:")
+		for i, sub := range re.Sub {
+			if i > 0 {
+				sb.WriteString("|")
+			}
+			if err := writeJSRegExp(sb, sub); err != nil {
+				return err
+			}
+		}
+		sb.WriteString(")")
+	default:
+		return fmt.Errorf("%s is not supported", re)
+	}
+	return nil
+}
+
+// writeJSAtom writes re as a single item a quantifier can apply to
+func writeJSAtom(sb *strings.Builder, re *syntax.Regexp) error {
+	switch {
+	case re.Op == syntax.OpLiteral && len(re.Rune) == 1, re.Op == syntax.OpCharClass, re.Op == syntax.OpAnyChar,
+		re.Op == syntax.OpAnyCharNotNL, re.Op == syntax.OpCapture:
+		return writeJSRegExp(sb, re)
+	}
+	sb.WriteString("(?:")
+	if err := writeJSRegExp(sb, re); err != nil {
+		return err
+	}
+	sb.WriteString(")")
+	return nil
+}
+
+// writeJSCharClass writes a class given as pairs of rune ranges. Classes matching all the runes
+// after some point, like negated classes, are written as the negation of their complement.
+func writeJSCharClass(sb *strings.Builder, ranges []rune) error {
+	if len(ranges) > 0 && ranges[len(ranges)-1] == unicode.MaxRune {
+		var complement []rune
+		next := rune(0)
+		for i := 0; i < len(ranges); i += 2 {
+			if ranges[i] > next {
+				complement = append(complement, next, ranges[i]-1)
+			}
+			next = ranges[i+1] + 1
+		}
+		return writeJSClass(sb, true, complement)
+	}
+	return writeJSClass(sb, false, ranges)
+}
+
+func writeJSClass(sb *strings.Builder, negated bool, ranges []rune) error {
+	sb.WriteString("[")
+	if negated {
+		sb.WriteString("^")
+	}
+	for i := 0; i < len(ranges); i += 2 {
+		lo, hi := ranges[i], ranges[i+1]
+		if hi > 0xFFFF {
+			return fmt.Errorf("character class with runes beyond U+FFFF is not supported")
+		}
+		writeJSClassRune(sb, lo)
+		if hi != lo {
+			sb.WriteString("-")
+			writeJSClassRune(sb, hi)
+		}
+	}
+	sb.WriteString("]")
+	return nil
+}
+
+// runePairs returns the ranges of a class holding each rune
+func runePairs(runes []rune) []rune {
+	pairs := make([]rune, 0, 2*len(runes))
+	for _, r := range runes {
+		pairs = append(pairs, r, r)
+	}
+	return pairs
+}
+
+// writeJSRune writes a rune matched literally, astral runes as their UTF-16 surrogates
+func writeJSRune(sb *strings.Builder, r rune) {
+	if r > 0xFFFF {
+		r -= 0x10000
+		fmt.Fprintf(sb, `\u%04X\u%04X`, 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+		return
+	}
+	writeJSClassRune(sb, r)
+}
+
+func writeJSClassRune(sb *strings.Builder, r rune) {
+	switch {
+	case r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		sb.WriteRune(r)
+	case r < 0x80 && unicode.IsPrint(r) && r != ' ':
+		// escaping punctuation never changes its meaning
+		sb.WriteString(`\`)
+		sb.WriteRune(r)
+	default:
+		fmt.Fprintf(sb, `\u%04X`, r)
+	}
+}
+
+// pacDirective returns the JavaScript expression of the PAC result for a proxy
+func pacDirective(upstream *Upstream, mode PACMode) string {
+	if upstream == nil {
+		return jsString("DIRECT")
+	}
+	if mode != PACModeUpstream {
+		return pacSelfVar
+	}
+	if directive, ok := pacProxies(upstream); ok {
+		return jsString(directive)
+	}
+	return pacSelfVar
+}
+
+// pacProxies returns the PAC result pointing directly to an upstream, failover groups being rendered as lists
+//
+// Rejected requests are sent to Sweetcher so it can refuse them, as well as requests to
+// chained proxies, ssh proxies and load balancing groups as PAC files can not express them.
+func pacProxies(upstream *Upstream) (string, bool) {
+	switch {
+	case upstream == nil:
+		return "DIRECT", true
+	case upstream == Reject || upstream.Via != nil || upstream.URL.Scheme == "ssh":
+		return "", false
+	case upstream.Group != nil && upstream.Group.Strategy != "" && upstream.Group.Strategy != Failover:
+		return "", false
+	case upstream.Group != nil:
+		directives := make([]string, 0, len(upstream.Group.Members))
+		for _, m := range upstream.Group.Members {
+			directive, ok := pacProxies(m)
+			if !ok {
+				return "", false
+			}
+			directives = append(directives, directive)
+		}
+		return strings.Join(directives, "; "), true
+	}
+	host := upstream.proxyAddr()
+	switch upstream.URL.Scheme {
+	case "https":
+		return "HTTPS " + host, true
+	case "socks5", "socks5h":
+		return "SOCKS5 " + host + "; SOCKS " + host, true
+	case "socks4", "socks4a":
+		return "SOCKS " + host, true
+	default:
+		return "PROXY " + host, true
+	}
+}
+
+func defaultProxyPort(scheme string) string {
+	switch scheme {
+	case "https":
+		return "443"
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return "1080"
+	case "ssh":
+		return "22"
+	default:
+		return "80"
+	}
+}
+
+// String returns the wildcard as it was written, an empty wildcard is rendered as "*"
+func (w wildcard) String() string {
+	if len(w) == 0 {
+		return "*"
+	}
+	return strings.Join(w, "*")
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
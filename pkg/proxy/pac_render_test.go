@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestProfile_renderPAC(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = orig }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("10.12.1.2")}, nil
+	}
+
+	main := makeUpstream(t, "https://masterproxy.yourcompany.it:8080")
+	hidden := makeUpstream(t, "http://hiddenproxy.yourcompany.it")
+	socks := makeUpstream(t, "socks5://127.0.0.1:1080")
+	lab, err := Chain(hidden, makeUpstream(t, "socks5h://socks.lab.it:1080"))
+	assert.NilError(t, err)
+	p, err := NewProfile(main, []Rule{
+		{Pattern: "gitlab.lab.it", Proxy: lab},
+		{Pattern: "*.github.io", Proxy: NewGroup("corporate", main, hidden, nil)},
+		{Pattern: "*.gitlab.io", Proxy: &Upstream{URL: makeURL(t, "group:balanced"), Group: &Group{Members: []*Upstream{main, hidden}, Strategy: RoundRobin}}},
+		{Pattern: "gist.github.com", Proxy: hidden},
+		{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/public/*", Proxy: nil},
+		{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/private/*", Proxy: hidden},
+		{Pattern: "*.yourcompany.it", Proxy: nil},
+		{Kind: HostRegex, Pattern: `^(build|ci)[0-9]+\.lab\.it$`, Proxy: socks},
+		{Kind: IPCIDR, Pattern: "2001:db8::/32", Proxy: nil},
+		{Kind: IPCIDR, Pattern: "10.12.0.0/16", Resolve: true, Proxy: nil},
+	})
+	assert.NilError(t, err)
+
+	tests := []struct {
+		url          string
+		host         string
+		wantSelf     string
+		wantUpstream string
+	}{
+		{"https://gitlab.lab.it/", "gitlab.lab.it", "PROXY 127.0.0.1:8080", "PROXY 127.0.0.1:8080"},
+		{"https://pages.github.io/", "pages.github.io", "PROXY 127.0.0.1:8080",
+			"HTTPS masterproxy.yourcompany.it:8080; PROXY hiddenproxy.yourcompany.it:80; DIRECT"},
+		{"https://pages.gitlab.io/", "pages.gitlab.io", "PROXY 127.0.0.1:8080", "PROXY 127.0.0.1:8080"},
+		{"https://gist.github.com/", "gist.github.com", "PROXY 127.0.0.1:8080", "PROXY hiddenproxy.yourcompany.it:80"},
+		{"http://repo.yourcompany.it/public/lib.jar", "repo.yourcompany.it", "DIRECT", "DIRECT"},
+		{"http://repo.yourcompany.it/private/lib.jar", "repo.yourcompany.it", "PROXY 127.0.0.1:8080", "PROXY hiddenproxy.yourcompany.it:80"},
+		{"https://repo.yourcompany.it/private/lib.jar", "repo.yourcompany.it", "DIRECT", "DIRECT"},
+		{"http://www.yourcompany.it/", "www.yourcompany.it", "DIRECT", "DIRECT"},
+		{"http://ci12.lab.it/", "ci12.lab.it", "PROXY 127.0.0.1:8080", "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080"},
+		{"http://www.google.com/", "www.google.com", "DIRECT", "DIRECT"},
+	}
+
+	for _, mode := range []PACMode{PACModeSelf, PACModeUpstream} {
+		script, err := p.renderPAC(mode)
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(script, "// rule #8"), "IPv6 rules can't be expressed in PAC scripts")
+		pac, err := NewPAC(`var sweetcher = "PROXY 127.0.0.1:8080";` + script)
+		assert.NilError(t, err)
+		for _, tt := range tests {
+			got, err := pac.FindProxy(tt.url, tt.host)
+			assert.NilError(t, err)
+			want := tt.wantSelf
+			if mode == PACModeUpstream {
+				want = tt.wantUpstream
+			}
+			assert.Equal(t, got, want, "mode %s url %s", mode, tt.url)
+		}
+	}
+
+	// Default proxy
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		return []netip.Addr{netip.MustParseAddr("203.0.113.1")}, nil
+	}
+	for mode, want := range map[PACMode]string{PACModeSelf: "PROXY 127.0.0.1:8080", PACModeUpstream: "HTTPS masterproxy.yourcompany.it:8080"} {
+		script, err := p.renderPAC(mode)
+		assert.NilError(t, err)
+		pac, err := NewPAC(`var sweetcher = "PROXY 127.0.0.1:8080";` + script)
+		assert.NilError(t, err)
+		got, err := pac.FindProxy("http://www.google.com/", "www.google.com")
+		assert.NilError(t, err)
+		assert.Equal(t, got, want)
+	}
+}
+
+func TestProfile_renderPACWithPAC(t *testing.T) {
+	pac, err := NewPAC(`function FindProxyForURL(url, host) { return isPlainHostName(host) ? "DIRECT" : "PROXY p1:8080"; }`)
+	assert.NilError(t, err)
+	p, err := NewProfile(nil, []Rule{{Pattern: "*.yourcompany.it", Proxy: nil}})
+	assert.NilError(t, err)
+	p.PAC = pac
+
+	script, err := p.renderPAC(PACModeUpstream)
+	assert.NilError(t, err)
+	generated, err := NewPAC(script)
+	assert.NilError(t, err)
+	for host, want := range map[string]string{"intranet": "DIRECT", "www.yourcompany.it": "DIRECT", "www.google.com": "PROXY p1:8080"} {
+		got, err := generated.FindProxy("http://"+host+"/", host)
+		assert.NilError(t, err)
+		assert.Equal(t, got, want)
+	}
+}
+
+func Test_proxy_servePAC(t *testing.T) {
+	p := newProxy()
+	profile, err := NewProfile(makeUpstream(t, "http://masterproxy.yourcompany.it:8080"), nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+
+	r := httptest.NewRequest(http.MethodGet, PACPath, nil)
+	r.Host = "127.0.0.1:8080"
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/x-ns-proxy-autoconfig")
+
+	pac, err := NewPAC(w.Body.String())
+	assert.NilError(t, err)
+	got, err := pac.FindProxy("http://www.google.com/", "www.google.com")
+	assert.NilError(t, err)
+	assert.Equal(t, got, "PROXY 127.0.0.1:8080")
+}
+
+func TestProfile_renderPACHostRegex(t *testing.T) {
+	socks := makeUpstream(t, "socks5://127.0.0.1:1080")
+	patterns := []string{
+		`(?i)^CI[0-9]+\.lab\.it$`,
+		`^(?P<env>dev|qa)-[^.]+\.lab\.it\z`,
+		`\Aintranet(?s:.)wiki\z`,
+		`^(?:[a-z]{2,3}\.){2}example\.(com|org)$`,
+		`^x(?i:Y+?)z\.example\.com$`,
+		`(?m)^build$`,
+	}
+	hosts := []string{"ci12.lab.it", "CI12.LAB.IT", "ci.lab.it", "dev-app.lab.it", "qa-app.lab.it", "prod-app.lab.it",
+		"dev-a.b.lab.it", "intranet.wiki", "intranet-wiki", "intranetwiki", "ab.cde.example.com", "ab.cdef.example.org",
+		"xYyz.example.com", "xz.example.com", "build", "k.lab.it"}
+	for _, pattern := range patterns {
+		t.Run(pattern, func(t *testing.T) {
+			p, err := NewProfile(nil, []Rule{{Kind: HostRegex, Pattern: pattern, Proxy: socks}})
+			assert.NilError(t, err)
+			script, err := p.renderPAC(PACModeUpstream)
+			assert.NilError(t, err)
+			pac, err := NewPAC(script)
+			assert.NilError(t, err)
+
+			_, translatable := pacCondition(p.matcher.rules[0])
+			if translatable != nil {
+				assert.Assert(t, strings.Contains(script, "// rule #0"), "the rule is commented out")
+			}
+			re := regexp.MustCompile(pattern)
+			matched := false
+			for _, host := range hosts {
+				got, err := pac.FindProxy("http://"+host+"/", host)
+				assert.NilError(t, err)
+				want := "DIRECT"
+				if re.MatchString(host) {
+					matched = true
+					if translatable == nil {
+						want = "SOCKS5 127.0.0.1:1080; SOCKS 127.0.0.1:1080"
+					}
+				}
+				assert.Equal(t, got, want, "host %s", host)
+			}
+			assert.Assert(t, matched, "some host matches %s", pattern)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+const testPAC = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".yourcompany.it")) {
+		return "DIRECT";
+	}
+	if (isInNet(host, "10.12.0.0", "255.255.0.0")) {
+		return "SOCKS 127.0.0.1:1080";
+	}
+	if (shExpMatch(url, "http://*.reddit.*/r/golang*")) {
+		return "PROXY hiddenproxy.yourcompany.it:8080; DIRECT";
+	}
+	if (dnsDomainLevels(host) > 3 || !weekdayRange("SUN", "SAT") || !timeRange(0, 24) || dateRange(2000, 2001)) {
+		return "DIRECT";
+	}
+	return "HTTPS masterproxy.yourcompany.it:8080";
+}
+`
+
+func TestPAC_chooseProxy(t *testing.T) {
+	defer func(orig func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = orig }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if host == "lab.example.com" {
+			return []netip.Addr{netip.MustParseAddr("10.12.1.2")}, nil
+		}
+		return []netip.Addr{netip.MustParseAddr("203.0.113.1")}, nil
+	}
+
+	pac, err := NewPAC(testPAC)
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want *url.URL
+	}{
+		{"PlainHostName", &http.Request{URL: makeURL(t, "http://intranet/")}, nil},
+		{"DomainIs", &http.Request{URL: makeURL(t, "http://www.yourcompany.it/")}, nil},
+		{"InNet", &http.Request{URL: makeURL(t, "http://lab.example.com/")}, makeURL(t, "socks5://127.0.0.1:1080")},
+		{"ShExpMatch", &http.Request{URL: makeURL(t, "http://www.reddit.com/r/golang/")}, &url.URL{Scheme: "group", Opaque: "PROXY hiddenproxy.yourcompany.it:8080; DIRECT"}},
+		{"ConnectHidesPath", &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "www.reddit.com:443"}}, makeURL(t, "https://masterproxy.yourcompany.it:8080")},
+		{"Default", &http.Request{URL: makeURL(t, "http://www.google.com/")}, makeURL(t, "https://masterproxy.yourcompany.it:8080")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pac.chooseProxy(tt.req)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, upstreamURL(got), tt.want)
+		})
+	}
+}
+
+func TestPAC_chooseProxyFallbacks(t *testing.T) {
+	pac, err := NewPAC(`function FindProxyForURL(url, host) { return "PROXY p1:8080;  PROXY p2:8080; DIRECT"; }`)
+	assert.NilError(t, err)
+	req := &http.Request{URL: makeURL(t, "http://www.google.com/")}
+	got, err := pac.chooseProxy(req)
+	assert.NilError(t, err)
+	assert.Assert(t, got.Group != nil, "fallback entries should be used as a failover group")
+	assert.Equal(t, got.Group.Name, "PROXY p1:8080; PROXY p2:8080; DIRECT")
+	assert.NilError(t, got.Validate())
+	assert.Equal(t, len(got.Group.Members), 3)
+	assert.DeepEqual(t, upstreamURL(got.Group.Members[0]), makeURL(t, "http://p1:8080"))
+	assert.DeepEqual(t, upstreamURL(got.Group.Members[1]), makeURL(t, "http://p2:8080"))
+	assert.Assert(t, got.Group.Members[2] == nil)
+
+	again, err := pac.chooseProxy(req)
+	assert.NilError(t, err)
+	assert.Assert(t, again == got, "groups should be reused so failed members stay skipped")
+}
+
+func TestPAC_timeouts(t *testing.T) {
+	defer func(orig time.Duration) { pacEvalTimeout = orig }(pacEvalTimeout)
+	pacEvalTimeout = 100 * time.Millisecond
+	defer func(orig time.Duration) { pacDNSTimeout = orig }(pacDNSTimeout)
+	pacDNSTimeout = 50 * time.Millisecond
+	defer func(orig func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = orig }(lookupNetIP)
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	pac, err := NewPAC(`function FindProxyForURL(url, host) {
+	if (host == "loop") {
+		while (true) {}
+	}
+	return isResolvable(host) ? "PROXY p1:8080" : "DIRECT";
+}`)
+	assert.NilError(t, err)
+	_, err = pac.FindProxy("http://loop/", "loop")
+	assert.ErrorContains(t, err, "PAC evaluation timed out after 100ms")
+	result, err := pac.FindProxy("http://slow.dns/", "slow.dns")
+	assert.NilError(t, err, "the script should be usable after an interruption")
+	assert.Equal(t, result, "DIRECT")
+
+	_, err = NewPAC(`while (true) {}`)
+	assert.ErrorContains(t, err, "PAC evaluation timed out")
+}
+
+func TestPAC_refresh(t *testing.T) {
+	var mu sync.Mutex
+	script := `function FindProxyForURL(url, host) { return "PROXY p1:8080"; }`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write([]byte(script))
+	}))
+	defer ts.Close()
+
+	pac, err := LoadPAC(context.Background(), ts.URL)
+	assert.NilError(t, err)
+	assert.Equal(t, pac.RefreshInterval, defaultPACRefresh)
+	pac.RefreshInterval = 50 * time.Millisecond
+	mu.Lock()
+	script = `function FindProxyForURL(url, host) { return "PROXY p2:8080"; }`
+	mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		result, err := pac.FindProxy("http://www.google.com/", "www.google.com")
+		if err != nil {
+			return poll.Error(err)
+		}
+		if result != "PROXY p2:8080" {
+			return poll.Continue("PAC file not refreshed yet, result is %q", result)
+		}
+		return poll.Success()
+	}, poll.WithDelay(10*time.Millisecond), poll.WithTimeout(5*time.Second))
+}
+
+func Test_parsePACResult(t *testing.T) {
+	tests := []struct {
+		result  string
+		want    []*url.URL
+		wantErr bool
+	}{
+		{"DIRECT", []*url.URL{nil}, false},
+		{"", []*url.URL{nil}, false},
+		{"PROXY p1:8080; SOCKS5 p2:1080 ; DIRECT", []*url.URL{makeURL(t, "http://p1:8080"), makeURL(t, "socks5://p2:1080"), nil}, false},
+		{"SOCKS4 p1:1080", []*url.URL{makeURL(t, "socks4://p1:1080")}, false},
+		{"PROXY", nil, true},
+		{"FTP p1:21", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.result, func(t *testing.T) {
+			got, err := parsePACResult(tt.result)
+			if tt.wantErr {
+				assert.Assert(t, err != nil)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestLoadPAC(t *testing.T) {
+	script := `function FindProxyForURL(url, host) { return "PROXY p1:8080"; }`
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+	assert.NilError(t, os.WriteFile(path, []byte(script), 0600))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = w.Write([]byte(script))
+	}))
+	defer ts.Close()
+
+	for _, location := range []string{path, "file://" + path, ts.URL + "/proxy.pac"} {
+		pac, err := LoadPAC(context.Background(), location)
+		assert.NilError(t, err)
+		result, err := pac.FindProxy("http://www.google.com/", "www.google.com")
+		assert.NilError(t, err)
+		assert.Equal(t, result, "PROXY p1:8080")
+	}
+
+	_, err := LoadPAC(context.Background(), ts.URL+"/missing.pac")
+	assert.ErrorContains(t, err, "404")
+	_, err = LoadPAC(context.Background(), filepath.Join(t.TempDir(), "missing.pac"))
+	assert.ErrorContains(t, err, "failed to load PAC file")
+
+	_, err = NewPAC(`var notAFunction = 1;`)
+	assert.ErrorContains(t, err, "does not define a FindProxyForURL function")
+	_, err = NewPAC(`function FindProxyForURL(url, host) {`)
+	assert.ErrorContains(t, err, "failed to evaluate PAC script")
+}
+
+func TestProfile_chooseProxyWithPAC(t *testing.T) {
+	pac, err := NewPAC(`function FindProxyForURL(url, host) { return "PROXY p1:8080"; }`)
+	assert.NilError(t, err)
+	p, err := NewProfile(nil, []Rule{{Pattern: "*.yourcompany.it", Proxy: nil}})
+	assert.NilError(t, err)
+	p.PAC = pac
+
+	got, err := p.chooseProxy(&http.Request{URL: makeURL(t, "http://www.yourcompany.it/")})
+	assert.NilError(t, err)
+	assert.Assert(t, got == nil, "rules should be evaluated before the PAC script")
+
+	got, err = p.chooseProxy(&http.Request{URL: makeURL(t, "http://www.google.com/")})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, upstreamURL(got), makeURL(t, "http://p1:8080"))
+}
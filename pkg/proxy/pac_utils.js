@@ -0,0 +1,162 @@
+// Standard Proxy Auto-Configuration helper functions.
+// dnsResolve, myIpAddress and alert are implemented in Go.
+
+function isPlainHostName(host) {
+    return host.indexOf('.') < 0;
+}
+
+function dnsDomainIs(host, domain) {
+    host = host.toLowerCase();
+    domain = domain.toLowerCase();
+    return host.length >= domain.length &&
+        host.substring(host.length - domain.length) == domain;
+}
+
+function localHostOrDomainIs(host, hostdom) {
+    return host == hostdom || hostdom.lastIndexOf(host + '.', 0) == 0;
+}
+
+function isResolvable(host) {
+    return dnsResolve(host) != null;
+}
+
+function convert_addr(ipchars) {
+    var bytes = ipchars.split('.');
+    return ((bytes[0] & 0xff) << 24) |
+        ((bytes[1] & 0xff) << 16) |
+        ((bytes[2] & 0xff) << 8) |
+        (bytes[3] & 0xff);
+}
+
+function isInNet(ipaddr, pattern, maskstr) {
+    var test = /^(\d{1,3})\.(\d{1,3})\.(\d{1,3})\.(\d{1,3})$/.exec(ipaddr);
+    if (test == null) {
+        ipaddr = dnsResolve(ipaddr);
+        if (ipaddr == null) {
+            return false;
+        }
+    } else if (test[1] > 255 || test[2] > 255 || test[3] > 255 || test[4] > 255) {
+        return false;
+    }
+    var host = convert_addr(ipaddr);
+    var pat = convert_addr(pattern);
+    var mask = convert_addr(maskstr);
+    return (host & mask) == (pat & mask);
+}
+
+function dnsDomainLevels(host) {
+    return host.split('.').length - 1;
+}
+
+function shExpMatch(url, pattern) {
+    pattern = pattern.replace(/[.+^${}()|[\]\\]/g, '\\$&');
+    pattern = pattern.replace(/\*/g, '.*');
+    pattern = pattern.replace(/\?/g, '.');
+    return new RegExp('^' + pattern + '$').test(url);
+}
+
+var wdays = { SUN: 0, MON: 1, TUE: 2, WED: 3, THU: 4, FRI: 5, SAT: 6 };
+var months = { JAN: 0, FEB: 1, MAR: 2, APR: 3, MAY: 4, JUN: 5, JUL: 6, AUG: 7, SEP: 8, OCT: 9, NOV: 10, DEC: 11 };
+
+// popGMT removes the optional trailing "GMT" argument and reports if it was present
+function popGMT(args) {
+    var gmt = args.length > 0 && args[args.length - 1] === 'GMT';
+    if (gmt) {
+        args.pop();
+    }
+    return gmt;
+}
+
+// inRange checks if value is in [start, end] allowing ranges to wrap around
+function inRange(start, value, end) {
+    if (start <= end) {
+        return start <= value && value <= end;
+    }
+    return value >= start || value <= end;
+}
+
+function weekdayRange() {
+    var args = Array.prototype.slice.call(arguments);
+    var gmt = popGMT(args);
+    var now = new Date();
+    var today = gmt ? now.getUTCDay() : now.getDay();
+    var start = wdays[args[0]];
+    var end = args.length > 1 ? wdays[args[1]] : start;
+    if (start === undefined || end === undefined) {
+        return false;
+    }
+    return inRange(start, today, end);
+}
+
+function dateRange() {
+    var args = Array.prototype.slice.call(arguments);
+    var gmt = popGMT(args);
+    var now = new Date();
+    var today = {
+        day: gmt ? now.getUTCDate() : now.getDate(),
+        month: gmt ? now.getUTCMonth() : now.getMonth(),
+        year: gmt ? now.getUTCFullYear() : now.getFullYear()
+    };
+    // each argument is a day of month, a month name or a year
+    var parts = [];
+    for (var i = 0; i < args.length; i++) {
+        if (typeof args[i] === 'string' && months[args[i]] !== undefined) {
+            parts.push({ month: months[args[i]] });
+        } else if (args[i] > 31) {
+            parts.push({ year: Number(args[i]) });
+        } else {
+            parts.push({ day: Number(args[i]) });
+        }
+    }
+    if (parts.length === 0 || parts.length > 6 || (parts.length > 1 && parts.length % 2 !== 0)) {
+        return false;
+    }
+    var half = Math.max(1, parts.length / 2);
+    var start = {}, end = {};
+    for (var j = 0; j < half; j++) {
+        Object.assign(start, parts[j]);
+        Object.assign(end, parts[parts.length === 1 ? j : half + j]);
+    }
+    // key builds a comparable value from the fields of d taking values from ref
+    var key = function (d, ref) {
+        return (d.year !== undefined ? ref.year : 0) * 10000 +
+            (d.month !== undefined ? ref.month : 0) * 100 +
+            (d.day !== undefined ? ref.day : 0);
+    };
+    var s = key(start, start), e = key(end, end), c = key(start, today);
+    if (start.year !== undefined) {
+        return s <= c && c <= e;
+    }
+    return inRange(s, c, e);
+}
+
+function timeRange() {
+    var args = Array.prototype.slice.call(arguments);
+    var gmt = popGMT(args);
+    var now = new Date();
+    var current = gmt ?
+        now.getUTCHours() * 3600 + now.getUTCMinutes() * 60 + now.getUTCSeconds() :
+        now.getHours() * 3600 + now.getMinutes() * 60 + now.getSeconds();
+    var start, end;
+    switch (args.length) {
+        case 1:
+            start = args[0] * 3600;
+            end = start + 3599;
+            break;
+        case 2:
+            start = args[0] * 3600;
+            end = args[1] * 3600 - 1;
+            break;
+        case 4:
+            start = args[0] * 3600 + args[1] * 60;
+            end = args[2] * 3600 + args[3] * 60 - 1;
+            break;
+        case 6:
+            start = args[0] * 3600 + args[1] * 60 + Number(args[2]);
+            end = args[3] * 3600 + args[4] * 60 + Number(args[5]);
+            break;
+        default:
+            return false;
+    }
+    return inRange(start, current, end);
+}
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// connPool manages the connections to an upstream proxy used for tunnels
+type connPool struct {
+	mu sync.Mutex
+	// warm holds connections established ahead of CONNECT requests
+	warm    []warmConn
+	filling int
+	// slots limits the concurrent connections when MaxConns is set
+	slots chan struct{}
+	// h2 multiplexes tunnels to proxies supporting HTTP/2
+	h2 *http2.ClientConn
+	// h2Dialing is closed once the pending dial of the HTTP/2 connection is over
+	h2Dialing chan struct{}
+	// h2Unsupported is set once the proxy refused to negotiate HTTP/2
+	h2Unsupported bool
+	// retired is set once the upstream is no longer used by the active profile, connections are then
+	// neither kept warm nor multiplexed
+	retired bool
+}
+
+type warmConn struct {
+	net.Conn
+	since time.Time
+}
+
+// warmUp establishes connections to the proxy in the background until WarmConns of them are ready
+func (u *Upstream) warmUp() {
+	p := &u.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retired {
+		return
+	}
+	for n := u.WarmConns - len(p.warm) - p.filling; n > 0; n-- {
+		p.filling++
+		go func() {
+			c, err := u.dialProxy(context.Background(), "tcp")
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.filling--
+			if err != nil {
+				slog.Debug("Failed to warm up connection to upstream proxy", "proxy", proxyName(u), "error", err)
+				return
+			}
+			if p.retired {
+				c.Close()
+				return
+			}
+			p.warm = append(p.warm, warmConn{Conn: c, since: time.Now()})
+		}()
+	}
+}
+
+// takeWarmConn returns a connection established ahead if one is available, nil otherwise
+func (u *Upstream) takeWarmConn() net.Conn {
+	if u.WarmConns <= 0 {
+		return nil
+	}
+	defer u.warmUp()
+	p := &u.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	idleTimeout := defaultDuration(u.IdleTimeout, defaultIdleTimeout)
+	for len(p.warm) > 0 {
+		c := p.warm[len(p.warm)-1]
+		p.warm = p.warm[:len(p.warm)-1]
+		if time.Since(c.since) < idleTimeout {
+			return c.Conn
+		}
+		c.Close()
+	}
+	return nil
+}
+
+// retireTunnelConns closes the warm connections, including the ones still being dialed, and the HTTP/2
+// connection once no tunnel uses it
+func (u *Upstream) retireTunnelConns() {
+	p := &u.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+	for _, c := range p.warm {
+		c.Close()
+	}
+	p.warm = nil
+	if p.h2 != nil {
+		// the HTTP/2 transport closes the connection once idle for IdleTimeout after its last tunnel
+		if p.h2.State().StreamsActive == 0 {
+			p.h2.Close()
+		}
+		p.h2 = nil
+	}
+}
+
+// acquireConn waits for the number of connections through the proxy to be under MaxConns, at most ConnectTimeout
+// if set. The returned function should be called once the connection is closed, it is nil if the number of
+// connections is not limited.
+func (u *Upstream) acquireConn(ctx context.Context) (release func(), err error) {
+	if u.MaxConns <= 0 {
+		return nil, nil
+	}
+	ctx, cancel := withTimeout(ctx, u.ConnectTimeout)
+	defer cancel()
+	p := &u.pool
+	p.mu.Lock()
+	if p.slots == nil {
+		p.slots = make(chan struct{}, u.MaxConns)
+	}
+	slots := p.slots
+	p.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+	default:
+		slog.Debug("Connections limit of upstream proxy reached, waiting for a connection to be closed",
+			"proxy", proxyName(u), "max_conns", u.MaxConns)
+		// connections kept alive for plain requests hold slots too
+		u.mu.Lock()
+		tr := u.transport
+		u.mu.Unlock()
+		if tr != nil {
+			tr.CloseIdleConnections()
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, &connLimitError{fmt.Errorf("no connection to upstream proxy %s available, %d are in use: %w", u.URL.Redacted(), u.MaxConns, ctx.Err())}
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-slots }) }, nil
+}
+
+// A connLimitError is returned when no connection to an upstream proxy is available within MaxConns,
+// the proxy was not contacted
+type connLimitError struct {
+	err error
+}
+
+func (e *connLimitError) Error() string { return e.err.Error() }
+
+func (e *connLimitError) Unwrap() error { return e.err }
+
+// limitDial makes dial wait for a connection slot with acquireConn,
+// the slot is released once the returned connection is closed
+func (u *Upstream) limitDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		release, err := u.acquireConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dial(ctx, network, addr)
+		switch {
+		case release == nil:
+			return c, err
+		case err != nil:
+			release()
+			return nil, err
+		default:
+			return trackConn(c, release), nil
+		}
+	}
+}
+
+// useHTTP2 returns true if tunnels should be multiplexed over HTTP/2,
+// NTLM authenticates connections and so requires HTTP/1.1
+func (u *Upstream) useHTTP2() bool {
+	return u.HTTP2 && u.URL.Scheme == "https" && u.Auth != authNTLM && u.authenticationScheme() != authNTLM
+}
+
+// http2Conn returns the HTTP/2 connection multiplexing tunnels to the proxy
+//
+// If the proxy does not support HTTP/2, nil is returned along with the connection negotiated
+// for HTTP/1.1 the first time and nothing later. Nothing is returned either once the upstream is retired,
+// its tunnels then use HTTP/1.1 connections closed with them. A single connection is dialed at a time,
+// without holding the pool lock, other callers wait for it.
+func (u *Upstream) http2Conn(ctx context.Context) (*http2.ClientConn, net.Conn, error) {
+	p := &u.pool
+	p.mu.Lock()
+	for {
+		if p.h2 != nil && p.h2.CanTakeNewRequest() {
+			defer p.mu.Unlock()
+			return p.h2, nil, nil
+		}
+		if p.h2Unsupported || p.retired {
+			p.mu.Unlock()
+			return nil, nil, nil
+		}
+		if p.h2Dialing == nil {
+			break
+		}
+		dialing := p.h2Dialing
+		p.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, nil, u.timeoutError(ctx, "HTTP/2 connection to", 0)
+		}
+		p.mu.Lock()
+	}
+	dialing := make(chan struct{})
+	p.h2Dialing = dialing
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.h2Dialing = nil
+		p.mu.Unlock()
+		close(dialing)
+	}()
+
+	c, err := u.dialProxy(ctx, "tcp", http2.NextProtoTLS, "http/1.1")
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlsConn, ok := c.(*tls.Conn); !ok || tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		p.mu.Lock()
+		p.h2Unsupported = true
+		p.mu.Unlock()
+		slog.Info("Upstream proxy does not support HTTP/2, tunnels use HTTP/1.1", "proxy", proxyName(u))
+		return nil, c, nil
+	}
+	// idle connections are closed so that the connection of a retired upstream does not outlive its tunnels
+	cc, err := (&http2.Transport{IdleConnTimeout: defaultDuration(u.IdleTimeout, defaultIdleTimeout)}).NewClientConn(c)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	slog.Debug("Connected to upstream proxy using HTTP/2", "proxy", proxyName(u))
+	p.mu.Lock()
+	if !p.retired {
+		p.h2 = cc
+	}
+	p.mu.Unlock()
+	return cc, nil, nil
+}
+
+// dialHTTP2 opens a tunnel to addr as a stream of an HTTP/2 connection to the proxy
+//
+// Streams are reset once their request context is done, so ctx only interrupts the CONNECT request
+// and the tunnel stream is canceled when it is closed.
+func (u *Upstream) dialHTTP2(ctx context.Context, cc *http2.ClientConn, addr string) (net.Conn, error) {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	var last *http.Response
+	var w *io.PipeWriter
+	connect := func(auth string, _ bool) (*http.Response, error) {
+		if last != nil {
+			last.Body.Close()
+			w.Close()
+		}
+		var r *io.PipeReader
+		r, w = io.Pipe()
+		req := (&http.Request{
+			Method:        http.MethodConnect,
+			URL:           &url.URL{Host: addr},
+			Host:          addr,
+			Header:        make(http.Header),
+			Body:          r,
+			ContentLength: -1,
+		}).WithContext(streamCtx)
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+		resp, err := cc.RoundTrip(req)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		last = resp
+		return resp, nil
+	}
+	var timer *time.Timer
+	if u.ResponseTimeout > 0 {
+		timer = time.AfterFunc(u.ResponseTimeout, cancel)
+	}
+	stop := context.AfterFunc(ctx, cancel)
+	resp, err := u.authenticate(http.MethodConnect, addr, connect)
+	if !stop() || (timer != nil && !timer.Stop()) {
+		cancel()
+		if resp != nil {
+			resp.Body.Close()
+		}
+		w.Close()
+		return nil, u.timeoutError(ctx, "CONNECT request to", u.ResponseTimeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer w.Close()
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return nil, err
+		}
+		return nil, &UpstreamError{
+			Proxy:      u.URL.Redacted(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return &http2Tunnel{r: resp.Body, w: w, cancel: cancel, proxyAddr: u.proxyAddr()}, nil
+}
+
+// http2Tunnel is a tunnel through an HTTP/2 stream, it does not support deadlines
+type http2Tunnel struct {
+	r         io.ReadCloser
+	w         *io.PipeWriter
+	cancel    context.CancelFunc
+	proxyAddr string
+}
+
+func (t *http2Tunnel) Read(b []byte) (int, error)  { return t.r.Read(b) }
+func (t *http2Tunnel) Write(b []byte) (int, error) { return t.w.Write(b) }
+
+// CloseWrite ends the request stream while the response can still be read
+func (t *http2Tunnel) CloseWrite() error { return t.w.Close() }
+
+func (t *http2Tunnel) Close() error {
+	defer t.cancel()
+	t.w.Close()
+	return t.r.Close()
+}
+
+func (t *http2Tunnel) LocalAddr() net.Addr  { return tunnelAddr("local") }
+func (t *http2Tunnel) RemoteAddr() net.Addr { return tunnelAddr(t.proxyAddr) }
+
+func (t *http2Tunnel) SetDeadline(time.Time) error {
+	return fmt.Errorf("deadlines are not supported by HTTP/2 tunnels")
+}
+
+func (t *http2Tunnel) SetReadDeadline(time.Time) error {
+	return fmt.Errorf("deadlines are not supported by HTTP/2 tunnels")
+}
+
+func (t *http2Tunnel) SetWriteDeadline(time.Time) error {
+	return fmt.Errorf("deadlines are not supported by HTTP/2 tunnels")
+}
+
+// tunnelAddr is the address of the ends of an HTTP/2 tunnel
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "h2" }
+func (a tunnelAddr) String() string  { return string(a) }
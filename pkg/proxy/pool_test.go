@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+// waitForConns waits for the fake upstream to have accepted n connections
+func waitForConns(t *testing.T, f *fakeUpstream, n int64) {
+	t.Helper()
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if conns := atomic.LoadInt64(&f.conns); conns != n {
+			return poll.Continue("%d connections accepted, waiting for %d", conns, n)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+}
+
+func TestUpstream_warmConns(t *testing.T) {
+	target := newHelloServer(t)
+	f := newFakeUpstream(t, nil)
+	u := makeUpstream(t, "http://"+f.Listener.Addr().String())
+	u.WarmConns = 2
+	assert.NilError(t, u.Validate())
+	t.Cleanup(u.retire)
+
+	u.warmUp()
+	waitForConns(t, f, 2)
+	c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	waitForConns(t, f, 3)
+	assert.Equal(t, atomic.LoadInt64(&f.connects), int64(1))
+}
+
+func TestUpstream_staleWarmConns(t *testing.T) {
+	target := newHelloServer(t)
+	f := newFakeUpstream(t, nil)
+	u := makeUpstream(t, "http://"+f.Listener.Addr().String())
+	u.WarmConns = 1
+	t.Cleanup(u.retire)
+
+	u.warmUp()
+	waitForConns(t, f, 1)
+	// the proxy closes the idle warm connection
+	f.CloseClientConnections()
+	c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+}
+
+func TestUpstream_maxConns(t *testing.T) {
+	target := newHelloServer(t)
+	f := newFakeUpstream(t, nil)
+	u := makeUpstream(t, "http://"+f.Listener.Addr().String())
+	u.MaxConns = 1
+	assert.NilError(t, u.Validate())
+
+	first, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	dialed := make(chan net.Conn)
+	go func() {
+		c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+		assert.Check(t, err)
+		dialed <- c
+	}()
+	select {
+	case <-dialed:
+		t.Fatal("second tunnel should wait for the first one to be closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, getThroughTunnel(t, first, target.URL), "hello")
+	var second net.Conn
+	select {
+	case second = <-dialed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second tunnel should be opened once the first one is closed")
+	}
+
+	u.ConnectTimeout = 50 * time.Millisecond
+	_, err = u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.ErrorContains(t, err, "no connection to upstream proxy")
+	assert.Equal(t, getThroughTunnel(t, second, target.URL), "hello")
+}
+
+func TestUpstream_maxConnsShared(t *testing.T) {
+	target := newHelloServer(t)
+	f := newFakeUpstream(t, nil)
+	socks := newFakeSocks(t, "", "")
+	for _, proxy := range []string{"http://" + f.Listener.Addr().String(), "socks5://" + socks.Addr().String()} {
+		t.Run(proxy, func(t *testing.T) {
+			u := makeUpstream(t, proxy)
+			u.MaxConns = 1
+			u.ConnectTimeout = 100 * time.Millisecond
+			assert.NilError(t, u.Validate())
+			t.Cleanup(u.retire)
+
+			req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+			assert.NilError(t, err)
+			resp, err := u.roundTrip(req)
+			assert.NilError(t, err)
+			_, err = u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			assert.ErrorContains(t, err, "no connection to upstream proxy", "requests and tunnels should share the limit")
+
+			_, err = io.Copy(io.Discard, resp.Body)
+			assert.NilError(t, err)
+			resp.Body.Close()
+			c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			assert.NilError(t, err, "idle connections of requests should be closed for tunnels")
+			assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+		})
+	}
+}
+
+func TestUpstream_HTTP2(t *testing.T) {
+	target := newHelloServer(t)
+	insecure, err := NewTLSConfig(TLSOptions{InsecureSkipVerify: true})
+	assert.NilError(t, err)
+	tests := []struct {
+		name      string
+		upstream  *fakeUpstream
+		wantConns int64
+	}{
+		{"Multiplexed", newFakeHTTP2Upstream(t), 1},
+		{"HTTP1Fallback", newFakeTLSUpstream(t, nil), 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := makeUpstream(t, "https://"+tt.upstream.Listener.Addr().String())
+			u.TLSConfig = insecure
+			u.HTTP2 = true
+			assert.NilError(t, u.Validate())
+			t.Cleanup(u.retire)
+
+			first, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			assert.NilError(t, err)
+			second, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, second, target.URL), "hello")
+			assert.Equal(t, getThroughTunnel(t, first, target.URL), "hello")
+			assert.Equal(t, atomic.LoadInt64(&tt.upstream.connects), int64(2))
+			assert.Equal(t, atomic.LoadInt64(&tt.upstream.conns), tt.wantConns)
+		})
+	}
+}
+
+func TestUpstream_HTTP2DialUnlocked(t *testing.T) {
+	u := makeUpstream(t, "https://"+newSilentListener(t).Addr().String())
+	u.HTTP2 = true
+	assert.NilError(t, u.Validate())
+	ctx, cancel := context.WithCancel(context.Background())
+	dialed := make(chan error)
+	go func() {
+		_, err := u.dial(ctx, "tcp", "127.0.0.1:80")
+		dialed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		u.pool.mu.Lock()
+		defer u.pool.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pool should not be locked while the HTTP/2 connection is dialed")
+	}
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	_, err := u.dial(waitCtx, "tcp", "127.0.0.1:80")
+	assert.ErrorContains(t, err, "HTTP/2 connection to upstream proxy")
+
+	cancel()
+	assert.Assert(t, <-dialed != nil)
+}
+
+func TestUpstream_retireTunnelConns(t *testing.T) {
+	target := newHelloServer(t)
+	t.Run("WarmConns", func(t *testing.T) {
+		f := newFakeUpstream(t, nil)
+		u := makeUpstream(t, "http://"+f.Listener.Addr().String())
+		u.WarmConns = 2
+		assert.NilError(t, u.Validate())
+
+		u.warmUp()
+		u.retire()
+		waitForConns(t, f, 2)
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			u.pool.mu.Lock()
+			defer u.pool.mu.Unlock()
+			if u.pool.filling > 0 || len(u.pool.warm) > 0 {
+				return poll.Continue("%d connections warming up, %d warm", u.pool.filling, len(u.pool.warm))
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+		u.warmUp()
+		assert.Equal(t, u.pool.filling, 0, "retired upstreams should not be warmed up")
+	})
+	t.Run("HTTP2", func(t *testing.T) {
+		f := newFakeHTTP2Upstream(t)
+		u := makeUpstream(t, "https://"+f.Listener.Addr().String())
+		var err error
+		u.TLSConfig, err = NewTLSConfig(TLSOptions{InsecureSkipVerify: true})
+		assert.NilError(t, err)
+		u.HTTP2 = true
+		u.IdleTimeout = 50 * time.Millisecond
+		assert.NilError(t, u.Validate())
+
+		c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+		assert.NilError(t, err)
+		cc := u.pool.h2
+		u.retire()
+		assert.Assert(t, !cc.State().Closed, "the connection should be kept while a tunnel uses it")
+		assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if !cc.State().Closed {
+				return poll.Continue("HTTP/2 connection still open")
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second), poll.WithDelay(10*time.Millisecond))
+	})
+}
+
+func TestUpstream_TLSSessionResumption(t *testing.T) {
+	target := newHelloServer(t)
+	var resumed int64
+	f := newFakeTLSUpstream(t, func(c *tls.Config) {
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.DidResume {
+				atomic.AddInt64(&resumed, 1)
+			}
+			return nil
+		}
+	})
+	u := makeUpstream(t, "https://"+f.Listener.Addr().String())
+	var err error
+	u.TLSConfig, err = NewTLSConfig(TLSOptions{InsecureSkipVerify: true})
+	assert.NilError(t, err)
+
+	for i := 0; i < 2; i++ {
+		c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+		assert.NilError(t, err)
+		assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	}
+	assert.Equal(t, atomic.LoadInt64(&resumed), int64(1))
+}
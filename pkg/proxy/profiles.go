@@ -1,61 +1,165 @@
 package proxy
 
 import (
-	"bufio"
-	"crypto/tls"
 	"errors"
-	"fmt"
-	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/loicalbertin/sweetcher/pkg/log"
-	xproxy "golang.org/x/net/proxy"
 )
 
-// A Rule allows to match an URL pattern to a proxy URL
+// A RuleKind defines how the Pattern of a Rule is matched against requests
+type RuleKind int
+
+const (
+	// HostWildcard rules match the request hostname against a wildcard pattern
+	// where '*' stands for any sequence of characters (ie. "*.google.com").
+	// This is the default kind of rule.
+	HostWildcard RuleKind = iota
+	// URLPattern rules match the request scheme, host, port and path against
+	// a wildcard URL pattern (ie. "http://repo.yourcompany.it/public/*").
+	// Any omitted part of the pattern matches everything.
+	//
+	// For CONNECT requests only the host and port of the target are known,
+	// so only the host part of the pattern is considered.
+	URLPattern
+	// IPCIDR rules match requests targeting an IP address in a CIDR block
+	// (ie. "10.12.0.0/16"), in an inclusive range of addresses (ie. "10.0.0.1-10.0.0.20")
+	// or a single IP address. If Resolve is set on the Rule, the hostnames of requests are
+	// resolved and the rule matches if any of the resolved addresses is in the range.
+	IPCIDR
+	// HostRegex rules match the request hostname against a regular expression
+	// (ie. `^(build|ci)[0-9]+\.yourcompany\.it$`). The expression is not implicitly anchored.
+	HostRegex
+)
+
+// Reject is a special upstream indicating that requests should be refused
+var Reject = &Upstream{URL: &url.URL{Scheme: "reject"}}
+
+// ErrRejected is returned when dialing a target that should be rejected by the active profile
+var ErrRejected = errors.New("request rejected by profile")
+
+// DefaultRejectMessage is the message sent to clients when their request is rejected
+// and the profile does not define a RejectMessage
+const DefaultRejectMessage = "Request blocked by Sweetcher"
+
+// A Rule allows to match an URL pattern to an upstream proxy
 //
-// The Proxy URL may be nil indicating that no proxy should be used (direct connection)
+// The Proxy may be nil indicating that no proxy should be used (direct connection)
+// or Reject indicating that requests should be refused
 type Rule struct {
+	Kind    RuleKind
 	Pattern string
-	Proxy   *url.URL
+	Proxy   *Upstream
+	// Resolve allows IPCIDR rules to match hostnames resolving into their range
+	Resolve bool
 }
 
-// A Profile is set of Rules and a Default proxy URL if none of the rules match
+// Validate checks that the rule pattern is valid for its kind
+func (r Rule) Validate() error {
+	_, err := compileRule(r)
+	return err
+}
+
+// A Profile is set of Rules and a Default proxy if none of the rules match
+//
+// The Default proxy may be nil indicating that no proxy should be used (direct connection)
+// or Reject indicating that requests should be refused
+//
+// If a PAC script is set, it is evaluated instead of using the Default proxy when none of
+// the rules match.
 //
-// The Default proxy URL may be nil indicating that no proxy should be used (direct connection)
+// Rules are compiled the first time the profile is used (or by NewProfile), so they should
+// not be modified afterward.
 type Profile struct {
-	Default *url.URL
+	Default *Upstream
 	Rules   []Rule
+	PAC     *PAC
+	// RejectMessage is sent to clients when their request is rejected, defaults to DefaultRejectMessage
+	RejectMessage string
+
+	compileOnce sync.Once
+	matcher     *matcher
+	compileErr  error
 }
 
-func (p *Profile) chooseProxy(req *http.Request) (*url.URL, error) {
-	for _, r := range p.Rules {
-		hostname := stripPort(req.URL)
-		logger := slog.With(
-			slog.String("hostname", hostname),
-			slog.String("pattern", r.Pattern),
-			slog.String("proxy", "direct"),
-		)
-		if r.Proxy != nil {
-			logger = logger.With(slog.String("proxy", r.Proxy.String()))
-		}
+// NewProfile creates a Profile and compiles its rules
+func NewProfile(def *Upstream, rules []Rule) (*Profile, error) {
+	p := &Profile{Default: def, Rules: rules}
+	return p, p.compile()
+}
 
-		logger.Log(req.Context(), log.LevelTrace, "check matching hostname against rule pattern")
-		rePattern := strings.Replace(r.Pattern, ".", `\.`, -1)
-		rePattern = strings.Replace(rePattern, "*", ".*", -1)
-		rePattern = "^" + rePattern + "$"
-		if ok, err := regexp.MatchString(rePattern, hostname); err == nil && ok {
-			logger.Debug("matched!")
-			return r.Proxy, nil
-		}
+func (p *Profile) compile() error {
+	p.compileOnce.Do(func() {
+		p.matcher, p.compileErr = compileRules(p.Rules)
+	})
+	return p.compileErr
+}
+
+// A Match describes the routing decision of a Profile for a request
+type Match struct {
+	// Rule is the index of the matching rule in the profile Rules or -1 if none matched
+	Rule int
+	// PAC is true if the proxy was chosen by the profile PAC script
+	PAC bool
+	// Proxy is the chosen proxy, nil for a direct connection or Reject
+	Proxy *Upstream
+}
+
+// Match returns the routing decision of the profile for the given request
+//
+// As for the requests received by Sweetcher, CONNECT requests are matched on their host only.
+func (p *Profile) Match(req *http.Request) (Match, error) {
+	if err := p.compile(); err != nil {
+		return Match{}, err
+	}
+	i := p.matcher.find(newTarget(req))
+	if i >= 0 {
+		return Match{Rule: i, Proxy: p.Rules[i].Proxy}, nil
 	}
+	if p.PAC != nil {
+		proxy, err := p.PAC.chooseProxy(req)
+		return Match{Rule: -1, PAC: true, Proxy: proxy}, err
+	}
+	return Match{Rule: -1, Proxy: p.Default}, nil
+}
 
-	return p.Default, nil
+func (p *Profile) chooseProxy(req *http.Request) (*Upstream, error) {
+	m, err := p.Match(req)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.With(slog.String("url", req.URL.String()), slog.String("proxy", proxyName(m.Proxy)))
+	switch {
+	case m.Rule >= 0:
+		logger.Debug("matched!", slog.Int("rule", m.Rule), slog.String("pattern", p.Rules[m.Rule].Pattern))
+	case m.PAC:
+		logger.Log(req.Context(), log.LevelTrace, "no rule matched, using PAC script", "pac", p.PAC.Location)
+	default:
+		logger.Log(req.Context(), log.LevelTrace, "no rule matched, using profile default")
+	}
+	return m.Proxy, nil
+}
+
+func (p *Profile) rejectMessage() string {
+	if p.RejectMessage == "" {
+		return DefaultRejectMessage
+	}
+	return p.RejectMessage
+}
+
+func proxyName(proxy *Upstream) string {
+	switch proxy {
+	case nil:
+		return "direct"
+	case Reject:
+		return "reject"
+	}
+	return proxy.URL.Redacted()
 }
 
 // Modified from url/url.go credit goes to the Go team
@@ -77,67 +181,45 @@ func stripPort(hostportURL *url.URL) string {
 	return hostport[:colon]
 }
 
+// dial connects to addr directly or through the proxy chosen for r, the request context
+// limits the establishment of the connection
 func (p *Profile) dial(r *http.Request, network, addr string) (net.Conn, error) {
 	proxy, err := p.chooseProxy(r)
 	if err != nil {
 		return nil, err
 	}
+	ctx := r.Context()
+	var direct net.Dialer
 	if proxy == nil {
-		return net.Dial(network, addr)
+		return direct.DialContext(ctx, network, addr)
 	}
-
-	switch proxy.Scheme {
-	case "http", "https":
-		return p.dialHTTP(proxy, network, addr)
-	case "socks5":
-		return p.dialSocks5(proxy, network, addr)
-	default:
-		return nil, fmt.Errorf("unsupported scheme %q for proxy %s", proxy.Scheme, proxy.String())
+	if proxy == Reject {
+		return nil, ErrRejected
 	}
+	host, _, _ := net.SplitHostPort(addr)
+	return failover(proxy, host, func(u *Upstream) (net.Conn, error) {
+		if u == nil {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return u.dial(ctx, network, addr)
+	}, trackConn)
 }
 
-func (p *Profile) dialSocks5(proxy *url.URL, network, addr string) (net.Conn, error) {
-	d, err := xproxy.SOCKS5(network, proxy.Host, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-	return d.Dial(network, addr)
-}
-
-func (p *Profile) dialHTTP(proxy *url.URL, network, addr string) (net.Conn, error) {
-	c, err := net.Dial(network, proxy.Host)
-	if err != nil {
-		return nil, err
-	}
-
-	if proxy.Scheme == "https" {
-		c = tls.Client(c, &tls.Config{InsecureSkipVerify: true})
-	}
-
-	connectReq := &http.Request{
-		Method: "CONNECT",
-		URL:    &url.URL{Opaque: addr},
-		Host:   addr,
-		Header: make(http.Header),
-	}
-	connectReq.Write(c)
-	// Read response.
-	// Okay to use and discard buffered reader here, because
-	// TLS server will not speak until spoken to.
-	br := bufio.NewReader(c)
-	resp, err := http.ReadResponse(br, connectReq)
-	if err != nil {
-		c.Close()
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		resp, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+// upstreams returns the proxies used by the profile rules and default, including the members of groups
+func (p *Profile) upstreams() []*Upstream {
+	var upstreams []*Upstream
+	for _, r := range append([]Rule{{Proxy: p.Default}}, p.Rules...) {
+		switch {
+		case r.Proxy == nil || r.Proxy == Reject:
+		case r.Proxy.Group != nil:
+			for _, m := range r.Proxy.Group.Members {
+				if m != nil {
+					upstreams = append(upstreams, m)
+				}
+			}
+		default:
+			upstreams = append(upstreams, r.Proxy)
 		}
-		c.Close()
-		return nil, errors.New("proxy refused connection" + string(resp))
 	}
-	return c, nil
+	return upstreams
 }
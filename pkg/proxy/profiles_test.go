@@ -1,10 +1,18 @@
 package proxy
 
 import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+
+	"gotest.tools/v3/assert"
 )
 
 func makeURL(t *testing.T, rawURL string) *url.URL {
@@ -15,11 +23,23 @@ func makeURL(t *testing.T, rawURL string) *url.URL {
 	return u
 }
 
+func makeUpstream(t *testing.T, rawURL string) *Upstream {
+	return NewUpstream(makeURL(t, rawURL))
+}
+
+// upstreamURL returns the URL of an upstream, nil for direct connections
+func upstreamURL(u *Upstream) *url.URL {
+	if u == nil {
+		return nil
+	}
+	return u.URL
+}
+
 func TestProfile_chooseProxy(t *testing.T) {
-	p1 := makeURL(t, "http://myproxy.mycomp.it:8080")
-	p2 := makeURL(t, "http://hiddenproxy.mycomp.it:8080")
+	p1 := makeUpstream(t, "http://myproxy.mycomp.it:8080")
+	p2 := makeUpstream(t, "http://hiddenproxy.mycomp.it:8080")
 	type fields struct {
-		Default *url.URL
+		Default *Upstream
 		Rules   []Rule
 	}
 	type args struct {
@@ -29,7 +49,7 @@ func TestProfile_chooseProxy(t *testing.T) {
 		name    string
 		fields  fields
 		args    args
-		want    *url.URL
+		want    *Upstream
 		wantErr bool
 	}{
 		{"TestNoMatchWithDirectDefault",
@@ -63,6 +83,56 @@ func TestProfile_chooseProxy(t *testing.T) {
 			}},
 			args{&http.Request{URL: makeURL(t, "http://test.google.com")}},
 			p1, false},
+		{"TestURLPatternMatchPath",
+			fields{p1, []Rule{
+				Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/public/*", Proxy: nil},
+				Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/private/*", Proxy: p2},
+			}},
+			args{&http.Request{URL: makeURL(t, "http://repo.yourcompany.it/public/libs/lib.jar")}},
+			nil, false},
+		{"TestURLPatternMatchOtherPath",
+			fields{p1, []Rule{
+				Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/public/*", Proxy: nil},
+				Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/private/*", Proxy: p2},
+			}},
+			args{&http.Request{URL: makeURL(t, "http://repo.yourcompany.it/private/libs/lib.jar")}},
+			p2, false},
+		{"TestURLPatternNoMatchScheme",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/public/*", Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "https://repo.yourcompany.it/public/libs/lib.jar")}},
+			p1, false},
+		{"TestURLPatternMatchDefaultPort",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "https://*.yourcompany.it:443", Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "https://repo.yourcompany.it/public/libs/lib.jar")}},
+			p2, false},
+		{"TestURLPatternNoMatchPort",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "*.yourcompany.it:8080/*", Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "http://repo.yourcompany.it/public/libs/lib.jar")}},
+			p1, false},
+		{"TestURLPatternMatchIPv6",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "http://[::1]:8080/*", Proxy: nil}}},
+			args{&http.Request{URL: makeURL(t, "http://[::1]:8080/index.html")}},
+			nil, false},
+		{"TestURLPatternConnectHostOnly",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/private/*", Proxy: p2}}},
+			args{&http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "repo.yourcompany.it:443"}}},
+			p2, false},
+		{"TestURLPatternConnectNoMatch",
+			fields{p1, []Rule{Rule{Kind: URLPattern, Pattern: "http://repo.yourcompany.it/private/*", Proxy: p2}}},
+			args{&http.Request{Method: http.MethodConnect, URL: &url.URL{Host: "www.yourcompany.it:443"}}},
+			p1, false},
+		{"TestHostRegexMatch",
+			fields{p1, []Rule{Rule{Kind: HostRegex, Pattern: `^(build|ci)[0-9]+\.yourcompany\.it$`, Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "http://ci12.yourcompany.it/job/1")}},
+			p2, false},
+		{"TestHostRegexNoMatch",
+			fields{p1, []Rule{Rule{Kind: HostRegex, Pattern: `^(build|ci)[0-9]+\.yourcompany\.it$`, Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "http://cix.yourcompany.it/job/1")}},
+			p1, false},
+		{"TestInvalidRule",
+			fields{p1, []Rule{Rule{Kind: HostRegex, Pattern: `^(build|ci`, Proxy: p2}}},
+			args{&http.Request{URL: makeURL(t, "http://ci12.yourcompany.it/job/1")}},
+			nil, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -81,3 +151,90 @@ func TestProfile_chooseProxy(t *testing.T) {
 		})
 	}
 }
+
+// getThroughTunnel sends a GET request to an http target through an established tunnel
+func getThroughTunnel(t *testing.T, c net.Conn, target string) string {
+	t.Helper()
+	defer c.Close()
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, req.Write(c))
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	assert.NilError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.NilError(t, err)
+	return string(b)
+}
+
+func newHelloServer(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestProfile_dialHTTPWithCredentials(t *testing.T) {
+	target := newHelloServer(t)
+	upstream := newFakeUpstream(t, basicAuthorizer("jdoe", "s3cr3t"))
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+
+	p := &Profile{Default: makeUpstream(t, "http://jdoe:s3cr3t@"+upstream.Listener.Addr().String())}
+	c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+
+	p = &Profile{Default: makeUpstream(t, "http://jdoe:wrong@"+upstream.Listener.Addr().String())}
+	_, err = p.dial(req, "tcp", target.Listener.Addr().String())
+	var upstreamErr *UpstreamError
+	assert.Assert(t, errors.As(err, &upstreamErr))
+	assert.Equal(t, upstreamErr.StatusCode, http.StatusProxyAuthRequired)
+	assert.ErrorContains(t, err, "requires authentication")
+	assert.Assert(t, !strings.Contains(err.Error(), "wrong"), "password should be redacted")
+}
+
+func TestProfile_dialSocks5WithCredentials(t *testing.T) {
+	target := newHelloServer(t)
+	socks := newFakeSocks(t, "jdoe", "s3cr3t")
+	req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+
+	p := &Profile{Default: makeUpstream(t, "socks5://jdoe:s3cr3t@"+socks.Addr().String())}
+	c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+
+	p = &Profile{Default: makeUpstream(t, "socks5://jdoe:wrong@"+socks.Addr().String())}
+	_, err = p.dial(req, "tcp", target.Listener.Addr().String())
+	assert.Assert(t, err != nil)
+}
+
+func TestProfile_dialHTTPWithChallengeAuthentication(t *testing.T) {
+	tests := []struct {
+		name      string
+		authorize func(w http.ResponseWriter, r *http.Request) bool
+		user      string
+	}{
+		{"NTLM", ntlmAuthorizer("jdoe", "s3cr3t"), "jdoe"},
+		{"NTLMWithDomain", ntlmAuthorizer("jdoe", "s3cr3t"), "CORP%5Cjdoe"},
+		{"Digest", digestAuthorizer("jdoe", "s3cr3t"), "jdoe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newHelloServer(t)
+			upstream := newFakeUpstream(t, tt.authorize)
+			req := &http.Request{Method: http.MethodConnect, URL: makeURL(t, target.URL)}
+
+			p := &Profile{Default: makeUpstream(t, "http://"+tt.user+":s3cr3t@"+upstream.Listener.Addr().String())}
+			c, err := p.dial(req, "tcp", target.Listener.Addr().String())
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+
+			p = &Profile{Default: makeUpstream(t, "http://"+tt.user+":wrong@"+upstream.Listener.Addr().String())}
+			_, err = p.dial(req, "tcp", target.Listener.Addr().String())
+			var upstreamErr *UpstreamError
+			assert.Assert(t, errors.As(err, &upstreamErr))
+			assert.Equal(t, upstreamErr.StatusCode, http.StatusProxyAuthRequired)
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"regexp"
 	"sync"
 	"sync/atomic"
@@ -24,26 +27,102 @@ import (
 // A proxy is responsible to handle requests and to forward them to the right proxy or directly
 // to the requested site.
 type proxy struct {
-	Tr              *http.Transport
-	profile         *Profile
+	Tr *http.Transport
+	// settings are replaced as a whole when the configuration is reloaded, connections being served
+	// keep using the snapshot they loaded
+	settings atomic.Pointer[proxySettings]
+
+	// profile is the active profile, it is replaced on reload while requests are served
+	profile         atomic.Pointer[Profile]
 	requestsCounter uint64
+	// pacScript holds the PAC script generated from the active profile
+	pacScript atomic.Value
+	// reload serializes the changes of the active profile
+	reload sync.Mutex
+	// stopHealthChecks stops the health checks of the active profile upstreams
+	stopHealthChecks func()
+}
+
+// proxySettings are the options of a proxy which may change when the configuration is reloaded,
+// they should not be modified once published
+type proxySettings struct {
+	pacMode PACMode
+	// dialTimeout limits the time to open tunnels, directly or through upstream proxies, and to connect
+	// to sites accessed directly by plain requests. Zero means no timeout.
+	dialTimeout time.Duration
+	// tunnelIdleTimeout closes tunnels no data went through for that long, zero means no timeout
+	tunnelIdleTimeout time.Duration
+	// socksAuth are the credentials SOCKS5 clients should authenticate with, nil allows anonymous clients.
+	// SOCKS4 clients are refused when set.
+	socksAuth *url.Userinfo
 }
 
 // SetProfile sets up the active profile
 func (p *proxy) SetProfile(profile *Profile) {
-	p.profile = profile
-	p.Tr.Proxy = profile.chooseProxy
+	p.reload.Lock()
+	defer p.reload.Unlock()
+	previous := p.profile.Swap(profile)
+	if p.stopHealthChecks != nil {
+		p.stopHealthChecks()
+	}
+	p.stopHealthChecks = startHealthChecks(profile.upstreams())
+	if previous != nil {
+		// connections to upstreams of the previous profile will not be reused
+		kept := make(map[*Upstream]bool)
+		for _, u := range profile.upstreams() {
+			kept[u] = true
+		}
+		for _, u := range previous.upstreams() {
+			if !kept[u] {
+				u.retire()
+			}
+		}
+	}
+	for _, u := range profile.upstreams() {
+		u.warmUp()
+	}
+	script, err := profile.renderPAC(p.settings.Load().pacMode)
+	if err != nil {
+		slog.Warn("Failed to generate PAC script from profile", "error", err)
+		script = ""
+	}
+	p.pacScript.Store(script)
+}
+
+// servePAC responds with the PAC script generated from the active profile
+func (p *proxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	script, _ := p.pacScript.Load().(string)
+	if script == "" {
+		http.Error(w, "No PAC script available", http.StatusServiceUnavailable)
+		return
+	}
+	self := r.Host
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "var %s = %s;\n\n%s", pacSelfVar, jsString("PROXY "+self), script)
 }
 
 // newProxy creates a Proxy with a properly configured http.Transport
 func newProxy() *proxy {
-	return &proxy{
-		Tr: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			Proxy: http.ProxyFromEnvironment,
-		},
+	p := &proxy{
+		// Tr is used for direct connections, upstreams have their own transport
+		Tr: &http.Transport{},
 	}
+	p.Tr.DialContext = p.dialDirect
+	p.settings.Store(&proxySettings{})
+	return p
+}
+
+// dialDirect connects to sites accessed directly by plain requests
+func (p *proxy) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := withTimeout(ctx, p.settings.Load().dialTimeout)
+	defer cancel()
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
 }
 
+// PACPath is the path of the PAC script generated from the active profile
+const PACPath = "/proxy.pac"
+
 var hasPort = regexp.MustCompile(`:\d+$`)
 
 func removeProxyHeaders(r *http.Request) {
@@ -89,16 +168,43 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else {
 		var err error
 		if !r.URL.IsAbs() {
+			if r.Method == http.MethodGet && r.URL.Path == PACPath {
+				p.servePAC(w, r)
+				return
+			}
+			if r.Method == http.MethodGet && r.URL.Path == StatusPath {
+				p.serveStatus(w, r)
+				return
+			}
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 			return
 		}
 
+		profile := p.profile.Load()
+		proxy, err := profile.chooseProxy(r)
+		if err != nil {
+			http.Error(w, err.Error(), 502)
+			return
+		}
+		if proxy == Reject {
+			logger.Debug("Rejecting request")
+			http.Error(w, profile.rejectMessage(), http.StatusForbidden)
+			return
+		}
 		removeProxyHeaders(r)
-		resp, err := p.Tr.RoundTrip(r)
+		resp, err := p.roundTrip(proxy, r)
 		if err != nil {
 			http.Error(w, err.Error(), 502)
 			return
 		}
+		if resp.StatusCode == http.StatusProxyAuthRequired && proxy != nil {
+			// a 407 would make the client think that Sweetcher requires authentication
+			resp.Body.Close()
+			err = &UpstreamError{Proxy: proxy.URL.Redacted(), Status: resp.Status, StatusCode: resp.StatusCode}
+			logger.Warn("Upstream proxy authentication failed", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 		origBody := resp.Body
 		defer origBody.Close()
 		// http.ResponseWriter will take care of filling the correct response length
@@ -121,8 +227,61 @@ func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// roundTrip forwards a plain request directly or through the given upstream.
+//
+// Requests to groups are sent again to the next member on failures only if they did not reach the failing one,
+// or if they are idempotent and their body could be buffered.
+func (p *proxy) roundTrip(upstream *Upstream, r *http.Request) (*http.Response, error) {
+	var body []byte
+	replayable := true
+	var sent atomic.Bool
+	if upstream != nil && upstream.Group != nil {
+		var buffered bool
+		var err error
+		body, buffered, err = bufferBody(r)
+		if err != nil {
+			return nil, err
+		}
+		replayable = buffered && isIdempotent(r)
+		trace := &httptrace.ClientTrace{WroteHeaders: func() { sent.Store(true) }}
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+	}
+	return failover(upstream, r.URL.Hostname(), func(u *Upstream) (*http.Response, error) {
+		if body != nil {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		sent.Store(false)
+		var resp *http.Response
+		var err error
+		if u == nil {
+			resp, err = p.Tr.RoundTrip(r)
+		} else {
+			resp, err = u.roundTrip(r)
+		}
+		if err != nil && sent.Load() && !replayable {
+			return nil, &stopFailover{err: err}
+		}
+		return resp, err
+	}, trackResponse)
+}
+
+// isIdempotent tells if a request may be sent twice, following the rules of http.Transport retries
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, hasKey := r.Header["Idempotency-Key"]
+	_, hasXKey := r.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
 func httpError(w io.WriteCloser, err error) {
-	errStr := fmt.Sprintf("HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", len(err.Error()), err.Error())
+	writeErrorAndClose(w, http.StatusBadGateway, err.Error())
+}
+
+func writeErrorAndClose(w io.WriteCloser, code int, msg string) {
+	errStr := fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n\r\n%s", code, http.StatusText(code), len(msg), msg)
 	if _, err := io.WriteString(w, errStr); err != nil {
 		slog.Warn("Error responding to client", "error", err)
 	}
@@ -141,39 +300,48 @@ func logCopyTime(ctx context.Context, logger *slog.Logger, start time.Time, copi
 	)
 }
 
-func copyOrWarn(ctx context.Context, logger *slog.Logger, way string, dst io.Writer, src io.Reader, wg *sync.WaitGroup) {
+func copyOrWarn(ctx context.Context, logger *slog.Logger, way string, dst io.Writer, src io.Reader, idle *idleWatch, wg *sync.WaitGroup) {
 	var copied int64
 	var err error
 	func() {
 		defer logCopyTime(ctx, logger, time.Now(), &copied, way)
-		if copied, err = io.Copy(dst, src); err != nil {
+		if copied, err = io.Copy(dst, idle.reader(src)); err != nil && !idle.expired() {
 			logger.Warn("Error copying to client", "error", err)
 		}
 	}()
+	idle.done()
 	wg.Done()
 }
 
-func proxyNotHalfClosableConnection(ctx context.Context, logger *slog.Logger, proxyClient, targetSiteCon net.Conn) {
+func proxyNotHalfClosableConnection(ctx context.Context, logger *slog.Logger, proxyClient, targetSiteCon net.Conn, idle *idleWatch) {
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go copyOrWarn(ctx, logger, "client_to_proxy", targetSiteCon, proxyClient, &wg)
-	go copyOrWarn(ctx, logger, "proxy_to_client", proxyClient, targetSiteCon, &wg)
+	go copyOrWarn(ctx, logger, "client_to_proxy", targetSiteCon, proxyClient, idle, &wg)
+	go copyOrWarn(ctx, logger, "proxy_to_client", proxyClient, targetSiteCon, idle, &wg)
 	wg.Wait()
 	proxyClient.Close()
 	targetSiteCon.Close()
 }
 
-func copyAndClose(ctx context.Context, logger *slog.Logger, way string, dst, src *net.TCPConn) {
+// halfClosableConn is a connection whose directions can be closed separately, like *net.TCPConn
+type halfClosableConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+func copyAndClose(ctx context.Context, logger *slog.Logger, way string, dst, src halfClosableConn, idle *idleWatch) {
 	// func() {
 	var copied int64
 	var err error
 	defer logCopyTime(ctx, logger, time.Now(), &copied, way)
-	if copied, err = io.Copy(dst, src); err != nil {
+	if copied, err = io.Copy(dst, idle.reader(src)); err != nil && !idle.expired() {
 		logger.Warn("Error copying to client", "error", err)
 	}
 	// }()
 	dst.CloseWrite()
 	src.CloseRead()
+	idle.done()
 }
 
 func (p *proxy) handleHTTPS(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
@@ -191,22 +359,98 @@ func (p *proxy) handleHTTPS(w http.ResponseWriter, r *http.Request, logger *slog
 	if !hasPort.MatchString(host) {
 		host += ":80"
 	}
-	targetSiteCon, err := p.profile.dial(r, "tcp", host)
+	profile := p.profile.Load()
+	targetSiteCon, err := p.dialTunnel(profile, r, host)
+	if errors.Is(err, ErrRejected) {
+		logger.Debug("Rejecting CONNECT to host")
+		writeErrorAndClose(proxyClient, http.StatusForbidden, profile.rejectMessage())
+		return
+	}
 	if err != nil {
+		logger.Warn("Failed to connect to host", "error", err)
 		httpError(proxyClient, err)
 		return
 	}
 	logger.Log(r.Context(), log.LevelTrace, "Accepting CONNECT to host")
 	proxyClient.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+	p.tunnel(r.Context(), logger, proxyClient, targetSiteCon)
+}
+
+// dialTunnel connects to the target of a tunnel using the route chosen by the profile for r, within DialTimeout
+func (p *proxy) dialTunnel(profile *Profile, r *http.Request, addr string) (net.Conn, error) {
+	ctx, cancel := withTimeout(r.Context(), p.settings.Load().dialTimeout)
+	defer cancel()
+	return profile.dial(r.WithContext(ctx), "tcp", addr)
+}
 
-	targetTCP, targetOK := targetSiteCon.(*net.TCPConn)
-	proxyClientTCP, clientOK := proxyClient.(*net.TCPConn)
-	ctx := r.Context()
+// tunnel copies data between a client and its target in the background until both are closed
+func (p *proxy) tunnel(ctx context.Context, logger *slog.Logger, proxyClient, targetSiteCon net.Conn) {
+	targetTCP, targetOK := targetSiteCon.(halfClosableConn)
+	proxyClientTCP, clientOK := proxyClient.(halfClosableConn)
+	idle := watchIdle(logger, p.settings.Load().tunnelIdleTimeout, proxyClient, targetSiteCon)
 	if targetOK && clientOK {
-		go copyAndClose(ctx, logger, "client_to_proxy", targetTCP, proxyClientTCP)
-		go copyAndClose(ctx, logger, "proxy_to_client", proxyClientTCP, targetTCP)
+		go copyAndClose(ctx, logger, "client_to_proxy", targetTCP, proxyClientTCP, idle)
+		go copyAndClose(ctx, logger, "proxy_to_client", proxyClientTCP, targetTCP, idle)
 	} else {
-		go proxyNotHalfClosableConnection(ctx, logger, proxyClient, targetSiteCon)
+		go proxyNotHalfClosableConnection(ctx, logger, proxyClient, targetSiteCon, idle)
+	}
+}
+
+// idleWatch closes both sides of a tunnel once no data went through it for a while,
+// its methods do nothing on a nil idleWatch
+type idleWatch struct {
+	timeout time.Duration
+	timer   *time.Timer
+	// copies counts the directions of the tunnel still copied
+	copies    atomic.Int32
+	isExpired atomic.Bool
+}
+
+// watchIdle starts watching a tunnel between two connections, it returns nil if timeout is zero
+func watchIdle(logger *slog.Logger, timeout time.Duration, a, b io.Closer) *idleWatch {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &idleWatch{timeout: timeout}
+	w.copies.Store(2)
+	w.timer = time.AfterFunc(timeout, func() {
+		w.isExpired.Store(true)
+		logger.Debug("Closing tunnel idle for too long", "idle_timeout", timeout)
+		a.Close()
+		b.Close()
+	})
+	return w
+}
+
+// reader returns a reader postponing the expiration each time data is read from r
+func (w *idleWatch) reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &activityReader{Reader: r, w: w}
+}
+
+// expired returns true if the tunnel was closed because it was idle
+func (w *idleWatch) expired() bool {
+	return w != nil && w.isExpired.Load()
+}
+
+// done stops watching the tunnel once both directions were copied
+func (w *idleWatch) done() {
+	if w != nil && w.copies.Add(-1) == 0 {
+		w.timer.Stop()
 	}
+}
+
+type activityReader struct {
+	io.Reader
+	w *idleWatch
+}
 
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 && !r.w.expired() {
+		r.w.timer.Reset(r.w.timeout)
+	}
+	return n, err
 }
@@ -1,14 +1,20 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"gotest.tools/v3/assert"
 )
@@ -32,10 +38,52 @@ func Test_proxyNotHalfClosableConnection(t *testing.T) {
 		wg.Done()
 	}()
 
-	proxyNotHalfClosableConnection(context.Background(), slog.Default(), c, s)
+	proxyNotHalfClosableConnection(context.Background(), slog.Default(), c, s, nil)
 	wg.Wait()
 }
 
+func Test_proxyTunnelIdleTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer target.Close()
+	p := newProxy()
+	p.settings.Store(&proxySettings{tunnelIdleTimeout: 200 * time.Millisecond})
+	profile, err := NewProfile(nil, nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.NilError(t, err)
+	defer c.Close()
+	assert.NilError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	fmt.Fprintf(c, "CONNECT %[1]s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", target.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	tc, err := target.Accept()
+	assert.NilError(t, err)
+	defer tc.Close()
+	assert.NilError(t, tc.SetDeadline(time.Now().Add(5*time.Second)))
+
+	// data going through the tunnel postpones its expiration
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		_, err = c.Write([]byte("ping"))
+		assert.NilError(t, err)
+		_, err = io.ReadFull(tc, buf)
+		assert.NilError(t, err)
+	}
+	// both sides are closed once the tunnel is idle
+	_, err = br.ReadByte()
+	assert.Equal(t, err, io.EOF)
+	_, err = tc.Read(buf)
+	assert.Equal(t, err, io.EOF)
+}
+
 type noopStrBuilderCloser struct {
 	*strings.Builder
 }
@@ -53,3 +101,149 @@ func Test_httpError(t *testing.T) {
 		t.Error("missing 502 error")
 	}
 }
+
+func Test_proxyReject(t *testing.T) {
+	p := newProxy()
+	profile, err := NewProfile(nil, []Rule{{Pattern: "telemetry.*", Proxy: Reject}})
+	assert.NilError(t, err)
+	profile.RejectMessage = "no telemetry please"
+	p.SetProfile(profile)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(makeURL(t, ts.URL))}}
+	resp, err := client.Get("http://telemetry.example.com/collect")
+	assert.NilError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusForbidden)
+	assert.Assert(t, strings.Contains(string(b), "no telemetry please"))
+
+	_, err = client.Get("https://telemetry.example.com/collect")
+	assert.ErrorContains(t, err, "Forbidden")
+}
+
+func TestServer_SetupProfileWhileServing(t *testing.T) {
+	target := newHelloServer(t)
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer tlsTarget.Close()
+	profile, err := NewProfile(nil, nil)
+	assert.NilError(t, err)
+	s := &Server{}
+	s.SetupProfile(profile)
+	ts := httptest.NewServer(s.proxy)
+	defer ts.Close()
+
+	stop := make(chan struct{})
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			s.DialTimeout = time.Duration(i%2+1) * time.Second
+			s.TunnelIdleTimeout = time.Duration(i%2+1) * time.Minute
+			profile, err := NewProfile(nil, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.SetupProfile(profile)
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-reloaded
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(makeURL(t, ts.URL)),
+		TLSClientConfig: tlsTarget.Client().Transport.(*http.Transport).TLSClientConfig,
+	}}
+	for i := 0; i < 20; i++ {
+		for _, u := range []string{target.URL, tlsTarget.URL, ts.URL + StatusPath} {
+			resp, err := client.Get(u)
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK, u)
+		}
+	}
+}
+
+func Test_proxyUpstreamAuthentication(t *testing.T) {
+	target := newHelloServer(t)
+	upstream := newFakeUpstream(t, basicAuthorizer("jdoe", "s3cr3t"))
+	p := newProxy()
+	profile, err := NewProfile(makeUpstream(t, "http://jdoe:wrong@"+upstream.Listener.Addr().String()),
+		[]Rule{{Pattern: "localhost", Proxy: makeUpstream(t, "http://jdoe:s3cr3t@"+upstream.Listener.Addr().String())}})
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+	ts := httptest.NewServer(p)
+	defer ts.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(makeURL(t, ts.URL))}}
+
+	resp, err := client.Get(strings.Replace(target.URL, "127.0.0.1", "localhost", 1))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+
+	resp, err = client.Get(target.URL)
+	assert.NilError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusBadGateway)
+	assert.Assert(t, strings.Contains(string(b), "requires authentication"))
+}
+
+func Test_proxyUpstreamChallengeAuthentication(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + string(b)))
+	}))
+	defer target.Close()
+	tests := []struct {
+		name      string
+		authorize func(w http.ResponseWriter, r *http.Request) bool
+	}{
+		{"NTLM", ntlmAuthorizer("jdoe", "s3cr3t")},
+		{"Digest", digestAuthorizer("jdoe", "s3cr3t")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := newFakeUpstream(t, tt.authorize)
+			p := newProxy()
+			profile, err := NewProfile(makeUpstream(t, "http://jdoe:s3cr3t@"+upstream.Listener.Addr().String()), nil)
+			assert.NilError(t, err)
+			p.SetProfile(profile)
+			ts := httptest.NewServer(p)
+			defer ts.Close()
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(makeURL(t, ts.URL))}}
+
+			// the first request learns the authentication scheme, the next ones use it directly
+			for i := 0; i < 2; i++ {
+				resp, err := client.Post(target.URL, "text/plain", strings.NewReader("payload"))
+				assert.NilError(t, err)
+				b, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.NilError(t, err)
+				assert.Equal(t, resp.StatusCode, http.StatusOK)
+				assert.Equal(t, string(b), "POST payload")
+
+				resp, err = client.Get(target.URL)
+				assert.NilError(t, err)
+				b, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				assert.NilError(t, err)
+				assert.Equal(t, string(b), "GET ")
+			}
+			assert.Equal(t, atomic.LoadInt64(&upstream.requests), int64(4))
+		})
+	}
+}
@@ -1,31 +1,76 @@
 package proxy
 
 import (
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 // A Server is responsible to serve http requests and proxy them to the direct target
 // or to another proxy based on the active Profile configuration
 type Server struct {
 	// Addr represents the Server address
-	Addr  string
-	proxy *proxy
+	Addr string
+	// PACMode defines where the PAC script served on PACPath points clients to,
+	// defaults to PACModeSelf
+	PACMode PACMode
+	// DialTimeout limits the time to connect to sites, directly or through upstream proxies for HTTPS tunnels,
+	// zero means no timeout
+	DialTimeout time.Duration
+	// TunnelIdleTimeout closes HTTPS and SOCKS tunnels no data went through for that long, zero means no timeout
+	TunnelIdleTimeout time.Duration
+	// SocksAddr is the address of an additional SOCKS4 and SOCKS5 listener routing connections like CONNECT
+	// requests, SOCKS clients are also accepted on Addr
+	SocksAddr string
+	// SocksAuth are the credentials SOCKS5 clients should authenticate with, nil allows anonymous clients.
+	// SOCKS4 clients, which can not send a password, are refused when set.
+	SocksAuth *url.Userinfo
+	proxy     *proxy
 }
 
-// ListenAndServe calls the http.ListenAndServe function
-// with the proxy handler
+// ListenAndServe serves HTTP proxy requests and SOCKS4 or SOCKS5 clients on Addr,
+// the protocol of each connection is detected from its first byte.
+// SOCKS clients are also served on SocksAddr if set.
 func (s *Server) ListenAndServe() error {
 	if s.proxy == nil {
 		s.proxy = newProxy()
 	}
-	return http.ListenAndServe(s.Addr, s.proxy)
-
+	addr := s.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	ml := s.proxy.listenMixed(l)
+	defer ml.Close()
+	if s.SocksAddr == "" {
+		return http.Serve(ml, s.proxy)
+	}
+	sl, err := net.Listen("tcp", s.SocksAddr)
+	if err != nil {
+		return err
+	}
+	defer sl.Close()
+	errs := make(chan error, 2)
+	go func() { errs <- s.proxy.serveSocks(sl) }()
+	go func() { errs <- http.Serve(ml, s.proxy) }()
+	return <-errs
 }
 
-// SetupProfile sets the active profile
+// SetupProfile sets the active profile, PACMode, DialTimeout, TunnelIdleTimeout and SocksAuth
+// are applied with it. Connections being served keep the settings they started with.
 func (s *Server) SetupProfile(profile *Profile) {
 	if s.proxy == nil {
 		s.proxy = newProxy()
 	}
+	s.proxy.settings.Store(&proxySettings{
+		pacMode:           s.PACMode,
+		dialTimeout:       s.DialTimeout,
+		tunnelIdleTimeout: s.TunnelIdleTimeout,
+		socksAuth:         s.SocksAuth,
+	})
 	s.proxy.SetProfile(profile)
 }
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// isSocks returns true for the schemes of SOCKS proxies
+func isSocks(scheme string) bool {
+	switch scheme {
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+// resolvesRemotely returns true if hostnames are sent to the proxy instead of being resolved locally
+func resolvesRemotely(scheme string) bool {
+	return scheme == "socks4a" || scheme == "socks5h"
+}
+
+// dialSocks connects to addr through a SOCKS proxy
+//
+// Like curl, "socks4" and "socks5" proxies receive addresses resolved locally
+// while "socks4a" and "socks5h" proxies resolve hostnames themselves.
+func (u *Upstream) dialSocks(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !resolvesRemotely(u.URL.Scheme) {
+		ipNetwork := "ip"
+		if u.URL.Scheme == "socks4" {
+			// SOCKS4 only supports IPv4 addresses
+			ipNetwork = "ip4"
+		}
+		var err error
+		addr, err = resolveAddr(ctx, ipNetwork, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.URL.Scheme == "socks5" || u.URL.Scheme == "socks5h" {
+		return u.dialSocks5(ctx, network, addr)
+	}
+	return u.dialSocks4(ctx, addr)
+}
+
+// resolveAddr replaces the hostname of addr by its first IP address
+func resolveAddr(ctx context.Context, network, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return addr, nil
+	}
+	ips, err := lookupNetIP(ctx, network, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no address found for %s", host)
+	}
+	return net.JoinHostPort(ips[0].Unmap().String(), port), nil
+}
+
+func (u *Upstream) dialSocks5(ctx context.Context, network, addr string) (net.Conn, error) {
+	var auth *xproxy.Auth
+	if u.URL.User != nil {
+		password, _ := u.URL.User.Password()
+		auth = &xproxy.Auth{User: u.URL.User.Username(), Password: password}
+	}
+	// the connection to the proxy is dialed here so that only the negotiation is limited by HandshakeTimeout
+	d, err := xproxy.SOCKS5(network, u.proxyAddr(), auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := u.dialForward(ctx, "tcp", u.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	err = u.handshake(ctx, c, "SOCKS5 negotiation with", func(ctx context.Context) error {
+		// x/net would set the connection deadline from ctx and report a raw i/o timeout,
+		// the negotiation is only interrupted by handshake instead
+		_, err := d.(socksConnDialer).DialWithConn(context.WithoutCancel(ctx), c, network, addr)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// socksConnDialer is implemented by the x/net/proxy SOCKS5 dialer to negotiate over an established connection
+type socksConnDialer interface {
+	DialWithConn(ctx context.Context, c net.Conn, network, addr string) (net.Addr, error)
+}
+
+// socks4Granted is the SOCKS4 reply code of accepted requests
+const socks4Granted = 90
+
+// dialSocks4 connects to addr through a SOCKS4 proxy, addr is sent as is using
+// the SOCKS4a extension if it is not an IPv4 address
+func (u *Upstream) dialSocks4(ctx context.Context, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], uint16(port))
+	ip, err := netip.ParseAddr(host)
+	remoteHost := err != nil
+	switch {
+	case !remoteHost && ip.Unmap().Is4():
+		req = append(req, ip.Unmap().AsSlice()...)
+	case !remoteHost:
+		return nil, fmt.Errorf("SOCKS4 proxy %s does not support IPv6 address %s", u.URL.Redacted(), host)
+	case u.URL.Scheme == "socks4":
+		return nil, fmt.Errorf("SOCKS4 proxy %s requires an IPv4 address, use socks4a to resolve %s remotely", u.URL.Redacted(), host)
+	default:
+		// SOCKS4a: an invalid IP address 0.0.0.x followed by the hostname after the user id
+		req = append(req, 0, 0, 0, 1)
+	}
+	if u.URL.User != nil {
+		req = append(req, u.URL.User.Username()...)
+	}
+	req = append(req, 0)
+	if remoteHost {
+		req = append(append(req, host...), 0)
+	}
+
+	c, err := u.dialForward(ctx, "tcp", u.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	err = u.handshake(ctx, c, "SOCKS4 negotiation with", func(context.Context) error {
+		if _, err := c.Write(req); err != nil {
+			return err
+		}
+		reply := make([]byte, 8)
+		if _, err := io.ReadFull(c, reply); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("SOCKS4 proxy %s closed the connection", u.URL.Redacted())
+			}
+			return err
+		}
+		if reply[1] != socks4Granted {
+			return fmt.Errorf("SOCKS4 proxy %s rejected connection to %s (code %d)", u.URL.Redacted(), addr, reply[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/loicalbertin/sweetcher/pkg/log"
+)
+
+// socksHandshakeTimeout disconnects SOCKS clients not sending their request in time
+const socksHandshakeTimeout = 30 * time.Second
+
+// SOCKS4 version and reply code of refused requests, accepted ones are replied socks4Granted
+const (
+	socks4Version  = 4
+	socks4Rejected = 91
+)
+
+// SOCKS5 authentication methods, commands, address types and reply codes (RFC 1928 and RFC 1929)
+const (
+	socks5Version          = 5
+	socks5NoAuth           = 0x00
+	socks5UserPassAuth     = 0x02
+	socks5NoAcceptableAuth = 0xff
+	socks5UserPassVersion  = 1
+
+	socks5Connect = 1
+
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5NotAllowed          = 2
+	socks5NetworkUnreachable  = 3
+	socks5HostUnreachable     = 4
+	socks5ConnectionRefused   = 5
+	socks5TTLExpired          = 6
+	socks5CommandNotSupported = 7
+	socks5AddrNotSupported    = 8
+)
+
+// serveSocks accepts SOCKS4 and SOCKS5 clients on l until it is closed
+func (p *proxy) serveSocks(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleSocks(c)
+	}
+}
+
+// handleSocks serves a SOCKS client, connections are routed by the active profile like CONNECT requests
+func (p *proxy) handleSocks(c net.Conn) {
+	reqID := atomic.AddUint64(&p.requestsCounter, 1)
+	logger := slog.With(slog.Uint64("requestID", reqID))
+
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil {
+		logger.Debug("Failed to read SOCKS request", "error", err)
+		c.Close()
+		return
+	}
+	version := b[0]
+	auth := p.settings.Load().socksAuth
+	var host string
+	var err error
+	switch version {
+	case socks4Version:
+		host, err = socks4Handshake(c, auth)
+	case socks5Version:
+		host, err = socks5Handshake(c, auth)
+	default:
+		logger.Debug("Unsupported SOCKS version", "version", version)
+		c.Close()
+		return
+	}
+	logger = logger.With(slog.String("protocol", fmt.Sprintf("socks%d", version)))
+	if err != nil {
+		logger.Debug("SOCKS handshake failed", "error", err)
+		c.Close()
+		return
+	}
+	logger = logger.With(slog.String("requested_host", host))
+
+	r := &http.Request{Method: http.MethodConnect, URL: &url.URL{Host: host}, Host: host, Header: make(http.Header)}
+	profile := p.profile.Load()
+	targetSiteCon, err := p.dialTunnel(profile, r, host)
+	if errors.Is(err, ErrRejected) {
+		logger.Debug("Rejecting CONNECT to host")
+		writeSocksReplyAndClose(c, version, socks5NotAllowed)
+		return
+	}
+	if err != nil {
+		logger.Warn("Failed to connect to host", "error", err)
+		writeSocksReplyAndClose(c, version, socks5ReplyCode(err))
+		return
+	}
+	if err := writeSocksReply(c, version, socks5Succeeded, targetSiteCon.LocalAddr()); err != nil {
+		logger.Warn("Error responding to client", "error", err)
+		c.Close()
+		targetSiteCon.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	ctx := context.Background()
+	logger.Log(ctx, log.LevelTrace, "Accepting CONNECT to host")
+	p.tunnel(ctx, logger, c, targetSiteCon)
+}
+
+// socks5Handshake authenticates a SOCKS5 client with auth, if not nil, and reads its request,
+// the version was already read. It returns the requested address.
+func socks5Handshake(c net.Conn, auth *url.Userinfo) (string, error) {
+	methods, err := readSocksBytes(c)
+	if err != nil {
+		return "", err
+	}
+	method := byte(socks5NoAuth)
+	if auth != nil {
+		method = socks5UserPassAuth
+	}
+	if !containsByte(methods, method) {
+		_, _ = c.Write([]byte{socks5Version, socks5NoAcceptableAuth})
+		return "", fmt.Errorf("client does not support authentication method %d", method)
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5UserPassAuth {
+		if err := socks5Authenticate(c, auth); err != nil {
+			return "", err
+		}
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", fmt.Errorf("unexpected SOCKS version %d in request", header[0])
+	}
+	if header[1] != socks5Connect {
+		_ = writeSocksReply(c, socks5Version, socks5CommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		b := make([]byte, 4)
+		if header[3] == socks5IPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			return "", err
+		}
+		ip, _ := netip.AddrFromSlice(b)
+		host = ip.String()
+	case socks5Domain:
+		b, err := readSocksBytes(c)
+		if err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		_ = writeSocksReply(c, socks5Version, socks5AddrNotSupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(c, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// socks4Handshake reads the request of a SOCKS4 or SOCKS4a client, the version was already read.
+// Clients are refused if auth is not nil. It returns the requested address.
+func socks4Handshake(c net.Conn, auth *url.Userinfo) (string, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return "", err
+	}
+	if _, err := readSocksString(c); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Connect {
+		_ = writeSocksReply(c, socks4Version, socks5CommandNotSupported, nil)
+		return "", fmt.Errorf("unsupported SOCKS4 command %d", header[0])
+	}
+	if auth != nil {
+		_ = writeSocksReply(c, socks4Version, socks5NotAllowed, nil)
+		return "", errors.New("SOCKS4 clients can not authenticate, SOCKS5 should be used")
+	}
+	ip := netip.AddrFrom4([4]byte(header[3:]))
+	host := ip.String()
+	if b := ip.As4(); b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] != 0 {
+		// SOCKS4a: the hostname follows the user id
+		var err error
+		if host, err = readSocksString(c); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(header[1])<<8|int(header[2]))), nil
+}
+
+// socks5Authenticate checks the username and password sent by the client against auth (RFC 1929)
+func socks5Authenticate(c net.Conn, auth *url.Userinfo) error {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(c, version); err != nil {
+		return err
+	}
+	if version[0] != socks5UserPassVersion {
+		return fmt.Errorf("unsupported SOCKS5 username/password authentication version %d", version[0])
+	}
+	user, err := readSocksBytes(c)
+	if err != nil {
+		return err
+	}
+	password, err := readSocksBytes(c)
+	if err != nil {
+		return err
+	}
+	wantPassword, _ := auth.Password()
+	userOK := subtle.ConstantTimeCompare(user, []byte(auth.Username()))
+	passwordOK := subtle.ConstantTimeCompare(password, []byte(wantPassword))
+	if userOK&passwordOK != 1 {
+		_, _ = c.Write([]byte{socks5UserPassVersion, 1})
+		return fmt.Errorf("invalid credentials for user %q", user)
+	}
+	_, err = c.Write([]byte{socks5UserPassVersion, 0})
+	return err
+}
+
+// readSocksBytes reads a field prefixed by its length
+func readSocksBytes(r io.Reader) ([]byte, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length[0])
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// readSocksString reads a null-terminated field of a SOCKS4 request
+func readSocksString(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == 255 {
+			return "", errors.New("SOCKS4 field too long")
+		}
+		s = append(s, b[0])
+	}
+}
+
+func containsByte(b []byte, c byte) bool {
+	for _, v := range b {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSocksReply sends the reply to a request with a SOCKS5 reply code and the address the target is connected
+// from. SOCKS4 clients are only told whether their request was granted.
+func writeSocksReply(w io.Writer, version, code byte, bound net.Addr) error {
+	if version == socks4Version {
+		status := byte(socks4Granted)
+		if code != socks5Succeeded {
+			status = socks4Rejected
+		}
+		_, err := w.Write([]byte{0, status, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	reply := []byte{socks5Version, code, 0}
+	var ip netip.Addr
+	var port uint16
+	if a, ok := bound.(*net.TCPAddr); ok {
+		ip = a.AddrPort().Addr().Unmap()
+		port = a.AddrPort().Port()
+	}
+	switch {
+	case ip.Is6():
+		reply = append(reply, socks5IPv6)
+	case ip.Is4():
+		reply = append(reply, socks5IPv4)
+	default:
+		reply = append(reply, socks5IPv4)
+		ip = netip.IPv4Unspecified()
+	}
+	reply = append(reply, ip.AsSlice()...)
+	reply = append(reply, byte(port>>8), byte(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+func writeSocksReplyAndClose(c net.Conn, version, code byte) {
+	if err := writeSocksReply(c, version, code, nil); err != nil {
+		slog.Warn("Error responding to client", "error", err)
+	}
+	if err := c.Close(); err != nil {
+		slog.Warn("Error closing client connection", "error", err)
+	}
+}
+
+// socks5ReplyCode returns the reply code of a SOCKS5 request that could not be connected
+func socks5ReplyCode(err error) byte {
+	var upstreamErr *UpstreamError
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, ErrRejected):
+		return socks5NotAllowed
+	case errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusForbidden:
+		return socks5NotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5NetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5HostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return socks5TTLExpired
+	}
+	return socks5GeneralFailure
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+	"gotest.tools/v3/assert"
+)
+
+// newSocksProxy serves SOCKS clients with the given profile
+func newSocksProxy(t *testing.T, profile *Profile, auth *url.Userinfo) string {
+	p := newProxy()
+	p.settings.Store(&proxySettings{socksAuth: auth})
+	p.SetProfile(profile)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() { _ = p.serveSocks(l) }()
+	return l.Addr().String()
+}
+
+func Test_proxySocks(t *testing.T) {
+	target := newHelloServer(t)
+	upstream := newFakeUpstream(t, nil)
+	profile, err := NewProfile(nil, []Rule{
+		{Pattern: "telemetry.*", Proxy: Reject},
+		{Pattern: "localhost", Proxy: makeUpstream(t, "http://"+upstream.Listener.Addr().String())},
+	})
+	assert.NilError(t, err)
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	tests := []struct {
+		name         string
+		serverAuth   *url.Userinfo
+		clientAuth   *xproxy.Auth
+		target       string
+		wantConnects int64
+		wantErr      string
+	}{
+		{"Direct", nil, nil, target.Listener.Addr().String(), 0, ""},
+		{"Upstream", nil, nil, "localhost:" + port, 1, ""},
+		{"Rejected", nil, nil, "telemetry.example.com:443", 0, "connection not allowed by ruleset"},
+		{"Refused", nil, nil, newDeadUpstream(t).URL.Host, 0, "connection refused"},
+		{"Authenticated", url.UserPassword("jdoe", "s3cr3t"), &xproxy.Auth{User: "jdoe", Password: "s3cr3t"}, target.Listener.Addr().String(), 0, ""},
+		{"WrongPassword", url.UserPassword("jdoe", "s3cr3t"), &xproxy.Auth{User: "jdoe", Password: "wrong"}, target.Listener.Addr().String(), 0, "username/password authentication failed"},
+		{"MissingCredentials", url.UserPassword("jdoe", "s3cr3t"), nil, target.Listener.Addr().String(), 0, "no acceptable authentication methods"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connects := atomic.LoadInt64(&upstream.connects)
+			d, err := xproxy.SOCKS5("tcp", newSocksProxy(t, profile, tt.serverAuth), tt.clientAuth, xproxy.Direct)
+			assert.NilError(t, err)
+			c, err := d.Dial("tcp", tt.target)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, c, "http://"+tt.target), "hello")
+			assert.Equal(t, atomic.LoadInt64(&upstream.connects), connects+tt.wantConnects)
+		})
+	}
+}
+
+func Test_proxySocks4(t *testing.T) {
+	target := newHelloServer(t)
+	upstream := newFakeUpstream(t, nil)
+	profile, err := NewProfile(nil, []Rule{
+		{Pattern: "telemetry.*", Proxy: Reject},
+		{Pattern: "localhost", Proxy: makeUpstream(t, "http://"+upstream.Listener.Addr().String())},
+	})
+	assert.NilError(t, err)
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	tests := []struct {
+		name         string
+		scheme       string
+		serverAuth   *url.Userinfo
+		target       string
+		wantConnects int64
+		wantErr      string
+	}{
+		{"Direct", "socks4", nil, target.Listener.Addr().String(), 0, ""},
+		{"RemoteHostname", "socks4a", nil, "localhost:" + port, 1, ""},
+		{"Rejected", "socks4a", nil, "telemetry.example.com:443", 0, "rejected connection to telemetry.example.com:443 (code 91)"},
+		{"AuthenticationRequired", "socks4", url.UserPassword("jdoe", "s3cr3t"), target.Listener.Addr().String(), 0, "code 91"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connects := atomic.LoadInt64(&upstream.connects)
+			u := makeUpstream(t, tt.scheme+"://"+newSocksProxy(t, profile, tt.serverAuth))
+			c, err := u.dial(context.Background(), "tcp", tt.target)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, c, "http://"+tt.target), "hello")
+			assert.Equal(t, atomic.LoadInt64(&upstream.connects), connects+tt.wantConnects)
+		})
+	}
+}
+
+func Test_socks5ReplyCode(t *testing.T) {
+	_, err := net.Dial("tcp", newDeadUpstream(t).URL.Host)
+	assert.Assert(t, err != nil)
+	assert.Equal(t, socks5ReplyCode(err), byte(socks5ConnectionRefused))
+	assert.Equal(t, socks5ReplyCode(ErrRejected), byte(socks5NotAllowed))
+	assert.Equal(t, socks5ReplyCode(&UpstreamError{StatusCode: http.StatusForbidden}), byte(socks5NotAllowed))
+	assert.Equal(t, socks5ReplyCode(&net.DNSError{Err: "no such host", IsNotFound: true}), byte(socks5HostUnreachable))
+	assert.Equal(t, socks5ReplyCode(&UpstreamError{StatusCode: http.StatusBadGateway}), byte(socks5GeneralFailure))
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestUpstream_dialSocks(t *testing.T) {
+	target := newHelloServer(t)
+	_, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	assert.NilError(t, err)
+	targetAddr := net.JoinHostPort("hello.test", port)
+	targetURL := "http://" + targetAddr
+
+	defer func(orig func(context.Context, string, string) ([]netip.Addr, error)) { lookupNetIP = orig }(lookupNetIP)
+	var localLookups int
+	lookupNetIP = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		localLookups++
+		if host != "hello.test" {
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	}
+
+	socks := newFakeSocks(t, "", "")
+	socks.hosts = map[string]string{"hello.test": "127.0.0.1"}
+	socksWithUser := newFakeSocks(t, "jdoe", "")
+	socksWithUser.hosts = socks.hosts
+
+	tests := []struct {
+		name       string
+		proxy      string
+		socks      *fakeSocks
+		wantTarget string
+		wantErr    string
+	}{
+		{"Socks4", "socks4://" + socks.Addr().String(), socks, "127.0.0.1:" + port, ""},
+		{"Socks4a", "socks4a://" + socks.Addr().String(), socks, targetAddr, ""},
+		{"Socks4UserID", "socks4a://jdoe@" + socksWithUser.Addr().String(), socksWithUser, targetAddr, ""},
+		{"Socks4WrongUserID", "socks4://jsmith@" + socksWithUser.Addr().String(), socksWithUser, "", "rejected connection"},
+		{"Socks5", "socks5://" + socks.Addr().String(), socks, "127.0.0.1:" + port, ""},
+		{"Socks5h", "socks5h://" + socks.Addr().String(), socks, targetAddr, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localLookups = 0
+			u := makeUpstream(t, tt.proxy)
+			assert.NilError(t, u.Validate())
+
+			c, err := u.dial(context.Background(), "tcp", targetAddr)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, c, targetURL), "hello")
+			assert.Equal(t, tt.socks.lastTarget(), tt.wantTarget)
+
+			req, err := http.NewRequest(http.MethodGet, targetURL, nil)
+			assert.NilError(t, err)
+			resp, err := u.roundTrip(req)
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+			assert.Equal(t, tt.socks.lastTarget(), tt.wantTarget)
+
+			if resolvesRemotely(u.URL.Scheme) {
+				assert.Equal(t, localLookups, 0, "hostnames should not be resolved locally")
+			} else {
+				assert.Equal(t, localLookups, 2)
+			}
+		})
+	}
+}
+
+func TestUpstream_dialSocks4IPv6(t *testing.T) {
+	u := makeUpstream(t, "socks4a://127.0.0.1:1080")
+	_, err := u.dial(context.Background(), "tcp", "[::1]:80")
+	assert.ErrorContains(t, err, "does not support IPv6")
+}
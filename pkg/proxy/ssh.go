@@ -0,0 +1,351 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSSHKeepAlive is the KeepAlive of ssh upstreams not defining one
+const defaultSSHKeepAlive = 30 * time.Second
+
+// SSHOptions define how Sweetcher authenticates to an ssh proxy and verifies its host key
+//
+// The user and an optional password are taken from the proxy URL.
+type SSHOptions struct {
+	// KeyFile is a PEM private key used for public key authentication
+	KeyFile string
+	// KeyPassphrase decrypts KeyFile if it is encrypted
+	KeyPassphrase string
+	// Agent enables public key authentication with the keys of the agent listening on SSH_AUTH_SOCK
+	Agent bool
+	// KnownHostsFile is the OpenSSH known_hosts file used to verify the host key, defaults to ~/.ssh/known_hosts
+	KnownHostsFile string
+	// InsecureIgnoreHostKey disables the verification of the host key. This should only be used for tests.
+	InsecureIgnoreHostKey bool
+}
+
+// NewSSHConfig creates the SSH configuration of an Upstream, loading the referenced files
+func NewSSHConfig(o SSHOptions) (*ssh.ClientConfig, error) {
+	c := &ssh.ClientConfig{}
+	if o.KeyFile != "" {
+		b, err := os.ReadFile(o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		var signer ssh.Signer
+		if o.KeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(b, []byte(o.KeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key file %q: %w", o.KeyFile, err)
+		}
+		c.Auth = append(c.Auth, ssh.PublicKeys(signer))
+	}
+	if o.Agent {
+		c.Auth = append(c.Auth, ssh.PublicKeysCallback((&sshAgent{}).signers))
+	}
+	if o.InsecureIgnoreHostKey {
+		c.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return c, nil
+	}
+	file := o.KnownHostsFile
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts file: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	var err error
+	c.HostKeyCallback, err = knownhosts.New(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts file: %w", err)
+	}
+	return c, nil
+}
+
+// sshAgent gives access to the keys of the SSH agent listening on SSH_AUTH_SOCK
+//
+// The connection to the agent is kept open as signers use it, it is opened again if the agent was restarted.
+type sshAgent struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (a *sshAgent) signers() ([]ssh.Signer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		signers, err := agent.NewClient(a.conn).Signers()
+		if err == nil {
+			return signers, nil
+		}
+		a.conn.Close()
+		a.conn = nil
+	}
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set, no SSH agent available")
+	}
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH agent: %w", err)
+	}
+	a.conn = c
+	return agent.NewClient(c).Signers()
+}
+
+// sshClient is the connection to an ssh proxy shared by the tunnels through it
+type sshClient struct {
+	mu     sync.Mutex
+	client *ssh.Client
+	// dialing is closed once the pending connection to the proxy is established or failed
+	dialing chan struct{}
+	// channels counts the tunnels opened through the client
+	channels int
+	// retired is set once the upstream is no longer used by the active profile,
+	// the client is then closed with its last tunnel
+	retired bool
+	// defaultConfig is used when the upstream has no SSHConfig
+	defaultConfig *ssh.ClientConfig
+}
+
+// sshConfig returns the SSH configuration of the upstream with the user and password of its URL,
+// it should be called with the lock of the ssh client held
+func (u *Upstream) sshConfig() (*ssh.ClientConfig, error) {
+	c := u.SSHConfig
+	if c == nil {
+		if u.ssh.defaultConfig == nil {
+			var err error
+			u.ssh.defaultConfig, err = NewSSHConfig(SSHOptions{Agent: true})
+			if err != nil {
+				return nil, err
+			}
+		}
+		c = u.ssh.defaultConfig
+	}
+	config := *c
+	config.User = u.URL.User.Username()
+	if password, ok := u.URL.User.Password(); ok {
+		config.Auth = append([]ssh.AuthMethod{ssh.Password(password)}, config.Auth...)
+	}
+	return &config, nil
+}
+
+// getSSHClient returns the connection to the ssh proxy, connecting it if needed
+//
+// A single connection is dialed at a time, without holding the lock of the ssh client,
+// other callers wait for it.
+func (u *Upstream) getSSHClient(ctx context.Context) (*ssh.Client, error) {
+	s := &u.ssh
+	s.mu.Lock()
+	for {
+		if s.client != nil {
+			defer s.mu.Unlock()
+			return s.client, nil
+		}
+		if s.dialing == nil {
+			break
+		}
+		dialing := s.dialing
+		s.mu.Unlock()
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, u.timeoutError(ctx, "SSH connection to", 0)
+		}
+		s.mu.Lock()
+	}
+	config, err := u.sshConfig()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	dialing := make(chan struct{})
+	s.dialing = dialing
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.dialing = nil
+		s.mu.Unlock()
+		close(dialing)
+	}()
+
+	c, err := u.dialForward(ctx, "tcp", u.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	var conn ssh.Conn
+	var chans <-chan ssh.NewChannel
+	var reqs <-chan *ssh.Request
+	err = u.handshake(ctx, c, "SSH handshake with", func(context.Context) error {
+		conn, chans, reqs, err = ssh.NewClientConn(c, u.proxyAddr(), config)
+		if err != nil {
+			return fmt.Errorf("SSH handshake with proxy %s failed: %w", u.URL.Redacted(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	s.mu.Lock()
+	s.client = client
+	s.mu.Unlock()
+	slog.Debug("Connected to SSH proxy", "proxy", proxyName(u))
+	go u.keepSSHAlive(client)
+	go func() {
+		err := client.Wait()
+		if u.dropSSHClient(client) {
+			slog.Info("SSH connection to proxy lost, it will be opened again when needed", "proxy", proxyName(u), "error", err)
+		}
+	}()
+	return client, nil
+}
+
+// dropSSHClient forgets a client if it is still the current one so that the next tunnel reconnects,
+// it returns false if it was already forgotten
+func (u *Upstream) dropSSHClient(client *ssh.Client) bool {
+	s := &u.ssh
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != client {
+		return false
+	}
+	s.client = nil
+	s.channels = 0
+	return true
+}
+
+// keepSSHAlive sends keepalive requests until the client is closed, closing it if the proxy does not answer
+func (u *Upstream) keepSSHAlive(client *ssh.Client) {
+	interval := defaultDuration(u.KeepAlive, defaultSSHKeepAlive)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		select {
+		case err := <-answered:
+			if err == nil {
+				continue
+			}
+			slog.Warn("SSH proxy keepalive failed", "proxy", proxyName(u), "error", err)
+		case <-time.After(interval):
+			slog.Warn("SSH proxy did not answer keepalive", "proxy", proxyName(u))
+		case <-closed:
+			return
+		}
+		client.Close()
+		return
+	}
+}
+
+// dialSSH connects to addr through a direct-tcpip channel of the ssh proxy, hostnames are resolved by the proxy
+func (u *Upstream) dialSSH(ctx context.Context, network, addr string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := u.getSSHClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := u.openSSHChannel(ctx, client, network, addr)
+		var openErr *ssh.OpenChannelError
+		if err != nil && !errors.As(err, &openErr) && !errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() == nil && attempt == 0 {
+			// the connection is broken but was not detected yet
+			client.Close()
+			u.dropSSHClient(client)
+			continue
+		}
+		if openErr != nil {
+			return nil, sshUpstreamError(u, openErr)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy %s failed to connect to %s: %w", u.URL.Redacted(), addr, err)
+		}
+		u.ssh.mu.Lock()
+		u.ssh.channels++
+		u.ssh.mu.Unlock()
+		var once sync.Once
+		return trackConn(c, func() {
+			once.Do(func() {
+				u.ssh.mu.Lock()
+				defer u.ssh.mu.Unlock()
+				if u.ssh.client == client {
+					u.ssh.channels--
+					u.ssh.closeIfRetired()
+				}
+			})
+		}), nil
+	}
+}
+
+// openSSHChannel opens a direct-tcpip channel waiting at most ResponseTimeout for the proxy to accept it
+func (u *Upstream) openSSHChannel(ctx context.Context, client *ssh.Client, network, addr string) (net.Conn, error) {
+	rctx, cancel := withTimeout(ctx, u.ResponseTimeout)
+	defer cancel()
+	c, err := client.DialContext(rctx, network, addr)
+	if err != nil && rctx.Err() != nil {
+		return nil, u.timeoutError(ctx, "channel request to", u.ResponseTimeout)
+	}
+	return c, err
+}
+
+// sshUpstreamError converts the refusal of a channel to the UpstreamError an HTTP proxy would have returned
+// so that refusals are handled the same way by groups and circuit breakers
+func sshUpstreamError(u *Upstream, err *ssh.OpenChannelError) *UpstreamError {
+	code := http.StatusBadGateway
+	if err.Reason == ssh.Prohibited {
+		code = http.StatusForbidden
+	}
+	return &UpstreamError{
+		Proxy:      u.URL.Redacted(),
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Body:       err.Message,
+	}
+}
+
+// retireSSHClient closes the connection to the ssh proxy once no tunnel uses it
+func (u *Upstream) retireSSHClient() {
+	s := &u.ssh
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retired = true
+	s.closeIfRetired()
+}
+
+// closeIfRetired closes the client of a retired upstream if no tunnel uses it,
+// it should be called with the lock held
+func (s *sshClient) closeIfRetired() {
+	if s.retired && s.client != nil && s.channels == 0 {
+		s.client.Close()
+		s.client = nil
+	}
+}
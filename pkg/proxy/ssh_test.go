@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gotest.tools/v3/assert"
+)
+
+// writeKnownHosts writes a known_hosts file trusting key for the server address
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key)
+	assert.NilError(t, os.WriteFile(path, []byte(line+"\n"), 0o600))
+	return path
+}
+
+// startSSHAgent serves an SSH agent holding key and points SSH_AUTH_SOCK to it
+func startSSHAgent(t *testing.T, key ed25519.PrivateKey) {
+	keyring := agent.NewKeyring()
+	assert.NilError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NilError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+}
+
+// newSSHKey generates a key and writes it to a PEM file
+func newSSHKey(t *testing.T) (key ed25519.PrivateKey, path string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NilError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	assert.NilError(t, err)
+	path = filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NilError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+	return key, path
+}
+
+func TestUpstream_dialSSH(t *testing.T) {
+	target := newHelloServer(t)
+	userKey, keyFile := newSSHKey(t)
+	userPublicKey, err := ssh.NewPublicKey(userKey.Public())
+	assert.NilError(t, err)
+	server := newFakeSSH(t, "jdoe", "s3cr3t", userPublicKey)
+	knownHosts := writeKnownHosts(t, server.Addr().String(), server.hostKey.PublicKey())
+	otherKnownHosts := writeKnownHosts(t, server.Addr().String(), newSSHSigner(t).PublicKey())
+	startSSHAgent(t, userKey)
+
+	tests := []struct {
+		name    string
+		proxy   string
+		options SSHOptions
+		wantErr string
+	}{
+		{"Password", "ssh://jdoe:s3cr3t@" + server.Addr().String(), SSHOptions{KnownHostsFile: knownHosts}, ""},
+		{"KeyFile", "ssh://jdoe@" + server.Addr().String(), SSHOptions{KnownHostsFile: knownHosts, KeyFile: keyFile}, ""},
+		{"Agent", "ssh://jdoe@" + server.Addr().String(), SSHOptions{KnownHostsFile: knownHosts, Agent: true}, ""},
+		{"WrongPassword", "ssh://jdoe:wrong@" + server.Addr().String(), SSHOptions{KnownHostsFile: knownHosts}, "unable to authenticate"},
+		{"UnknownHostKey", "ssh://jdoe:s3cr3t@" + server.Addr().String(), SSHOptions{KnownHostsFile: otherKnownHosts}, "key mismatch"},
+		{"InsecureIgnoreHostKey", "ssh://jdoe:s3cr3t@" + server.Addr().String(), SSHOptions{InsecureIgnoreHostKey: true}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := makeUpstream(t, tt.proxy)
+			var err error
+			u.SSHConfig, err = NewSSHConfig(tt.options)
+			assert.NilError(t, err)
+			assert.NilError(t, u.Validate())
+			t.Cleanup(u.retire)
+
+			c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+		})
+	}
+}
+
+func TestUpstream_sshReconnect(t *testing.T) {
+	target := newHelloServer(t)
+	server := newFakeSSH(t, "jdoe", "s3cr3t")
+	u := makeUpstream(t, "ssh://jdoe:s3cr3t@"+server.Addr().String())
+	u.SSHConfig = &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey())}
+	t.Cleanup(u.retire)
+
+	for i := 0; i < 2; i++ {
+		c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+		assert.NilError(t, err)
+		assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	}
+	assert.Equal(t, atomic.LoadInt64(&server.handshakes), int64(1), "tunnels should share the SSH connection")
+
+	server.disconnect()
+	c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+	assert.Equal(t, atomic.LoadInt64(&server.handshakes), int64(2))
+
+	dead := newDeadUpstream(t)
+	_, err = u.dial(context.Background(), "tcp", dead.URL.Host)
+	var upstreamErr *UpstreamError
+	assert.Assert(t, errors.As(err, &upstreamErr), err)
+	assert.Equal(t, upstreamErr.StatusCode, http.StatusBadGateway)
+}
+
+func TestUpstream_sshRetire(t *testing.T) {
+	target := newHelloServer(t)
+	server := newFakeSSH(t, "jdoe", "s3cr3t")
+	u := makeUpstream(t, "ssh://jdoe:s3cr3t@"+server.Addr().String())
+	u.SSHConfig = &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey())}
+
+	c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+	assert.NilError(t, err)
+	client := u.ssh.client
+	u.retire()
+	assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello", "open tunnels should keep working once retired")
+
+	closed := make(chan struct{})
+	go func() {
+		_ = client.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the SSH connection should be closed with the last tunnel of a retired upstream")
+	}
+	u.ssh.mu.Lock()
+	defer u.ssh.mu.Unlock()
+	assert.Assert(t, u.ssh.client == nil)
+}
+
+func TestUpstream_sshDialUnlocked(t *testing.T) {
+	u := makeUpstream(t, "ssh://jdoe:s3cr3t@"+newSilentListener(t).Addr().String())
+	u.SSHConfig = &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	ctx, cancel := context.WithCancel(context.Background())
+	dialed := make(chan error)
+	go func() {
+		_, err := u.dial(ctx, "tcp", "127.0.0.1:80")
+		dialed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	retired := make(chan struct{})
+	go func() {
+		u.retire()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the SSH client should not be locked while the proxy is dialed")
+	}
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	_, err := u.dial(waitCtx, "tcp", "127.0.0.1:80")
+	assert.ErrorContains(t, err, "SSH connection to upstream proxy")
+
+	cancel()
+	assert.Assert(t, <-dialed != nil)
+}
+
+func Test_proxySSH(t *testing.T) {
+	target := newHelloServer(t)
+	server := newFakeSSH(t, "jdoe", "s3cr3t")
+	u := makeUpstream(t, "ssh://jdoe:s3cr3t@"+server.Addr().String())
+	u.SSHConfig = &ssh.ClientConfig{HostKeyCallback: ssh.FixedHostKey(server.hostKey.PublicKey())}
+	p := newProxy()
+	profile, err := NewProfile(u, nil)
+	assert.NilError(t, err)
+	p.SetProfile(profile)
+	t.Cleanup(u.retire)
+
+	r := httptest.NewRequest(http.MethodGet, target.URL, nil)
+	r.RequestURI = ""
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), "hello")
+}
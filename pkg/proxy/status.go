@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// StatusPath is the path of the JSON status of the upstreams used by the active profile
+const StatusPath = "/status"
+
+// UpstreamStatus is the state of an upstream proxy used by the active profile
+type UpstreamStatus struct {
+	// Proxy is the redacted URL of the upstream
+	Proxy string `json:"proxy"`
+	// Health is only set for upstreams having a health check
+	Health *HealthStatus `json:"health,omitempty"`
+	// Latency is only set for upstreams with latency measurements
+	Latency *LatencyStatus `json:"latency,omitempty"`
+	// Circuit is only set for upstreams having a circuit breaker
+	Circuit *CircuitStatus `json:"circuit,omitempty"`
+}
+
+// status returns the state of the upstreams used by the active profile
+func (p *proxy) status() []UpstreamStatus {
+	statuses := []UpstreamStatus{}
+	profile := p.profile.Load()
+	if profile == nil {
+		return statuses
+	}
+	seen := make(map[*Upstream]bool)
+	for _, u := range profile.upstreams() {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		s := UpstreamStatus{Proxy: u.URL.Redacted()}
+		if u.HealthCheck != nil {
+			health := u.Health()
+			s.Health = &health
+		}
+		if latency := u.Latency(); latency.Samples > 0 {
+			s.Latency = &latency
+		}
+		if u.CircuitBreaker != nil {
+			circuit := u.Circuit()
+			s.Circuit = &circuit
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// serveStatus responds with the state of the upstreams used by the active profile
+func (p *proxy) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(struct {
+		Upstreams []UpstreamStatus `json:"upstreams"`
+	}{p.status()})
+}
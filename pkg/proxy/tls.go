@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSOptions define how connections to an https proxy are secured
+//
+// By default the proxy certificate is verified using the system roots.
+type TLSOptions struct {
+	// CAFile is a PEM bundle of certificate authorities used instead of the system roots
+	CAFile string
+	// CertFile and KeyFile are a PEM certificate and key used to authenticate to proxies requiring mutual TLS
+	CertFile string
+	KeyFile  string
+	// Pins are SHA-256 fingerprints of certificates, hex encoded with or without colons
+	// (ie. as printed by "openssl x509 -noout -fingerprint -sha256"). If set, one of the certificates
+	// presented by the proxy should match one of them.
+	Pins []string
+	// ServerName is used to verify the proxy certificate and sent in the TLS handshake instead of the proxy hostname
+	ServerName string
+	// InsecureSkipVerify disables the verification of the proxy certificate chain and hostname,
+	// pins are still checked. This should only be used for broken proxies.
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig creates the TLS configuration of an Upstream, loading the referenced files
+func NewTLSConfig(o TLSOptions) (*tls.Config, error) {
+	c := &tls.Config{ServerName: o.ServerName, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		b, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no PEM certificate found in CA file %q", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.Pins) > 0 {
+		pins := make([][]byte, 0, len(o.Pins))
+		for _, pin := range o.Pins {
+			fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+			if err != nil || len(fingerprint) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin %q, should be an hex encoded SHA-256 fingerprint", pin)
+			}
+			pins = append(pins, fingerprint)
+		}
+		c.VerifyConnection = verifyPins(pins)
+	}
+	return c, nil
+}
+
+// verifyPins returns a tls.Config VerifyConnection function checking that one of the peer
+// certificates matches one of the pinned fingerprints
+func verifyPins(pins [][]byte) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, cert := range cs.PeerCertificates {
+			fingerprint := sha256.Sum256(cert.Raw)
+			for _, pin := range pins {
+				if bytes.Equal(fingerprint[:], pin) {
+					return nil
+				}
+			}
+		}
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("no certificate presented by %s to check pins", cs.ServerName)
+		}
+		return fmt.Errorf("certificate of %s does not match any pinned fingerprint, its fingerprint is %s",
+			cs.ServerName, Fingerprint(cs.PeerCertificates[0]))
+	}
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate in the format expected by TLSOptions pins
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+// writePEM writes a PEM block in a temporary file and returns its path
+func writePEM(t *testing.T, name, blockType string, b []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NilError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0o600))
+	return path
+}
+
+// newClientCertificate generates a self-signed client certificate, returning it with its certificate and key files
+func newClientCertificate(t *testing.T) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sweetcher"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NilError(t, err)
+	return cert, writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client-key.pem", "PRIVATE KEY", keyDER)
+}
+
+func TestUpstream_TLS(t *testing.T) {
+	target := newHelloServer(t)
+	upstream := newFakeTLSUpstream(t, nil)
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", upstream.Certificate().Raw)
+	otherCert, _, _ := newClientCertificate(t)
+
+	clientCert, certFile, keyFile := newClientCertificate(t)
+	mtlsUpstream := newFakeTLSUpstream(t, func(c *tls.Config) {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = x509.NewCertPool()
+		c.ClientCAs.AddCert(clientCert)
+	})
+
+	tests := []struct {
+		name     string
+		upstream *fakeUpstream
+		options  *TLSOptions
+		wantErr  string
+	}{
+		{"SystemRootsByDefault", upstream, nil, "certificate signed by unknown authority"},
+		{"CAFile", upstream, &TLSOptions{CAFile: caFile}, ""},
+		{"ServerNameMismatch", upstream, &TLSOptions{CAFile: caFile, ServerName: "proxy.yourcompany.it"}, "proxy.yourcompany.it"},
+		{"ServerName", upstream, &TLSOptions{CAFile: caFile, ServerName: "example.com"}, ""},
+		{"Pin", upstream, &TLSOptions{InsecureSkipVerify: true, Pins: []string{Fingerprint(upstream.Certificate())}}, ""},
+		{"LowerCasePinWithoutColons", upstream, &TLSOptions{CAFile: caFile,
+			Pins: []string{strings.ToLower(strings.ReplaceAll(Fingerprint(upstream.Certificate()), ":", ""))}}, ""},
+		{"PinMismatch", upstream, &TLSOptions{CAFile: caFile, Pins: []string{Fingerprint(otherCert)}}, "does not match any pinned fingerprint"},
+		{"InsecureSkipVerify", upstream, &TLSOptions{InsecureSkipVerify: true}, ""},
+		{"MissingClientCertificate", mtlsUpstream, &TLSOptions{InsecureSkipVerify: true}, "certificate required"},
+		{"ClientCertificate", mtlsUpstream, &TLSOptions{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := makeUpstream(t, "https://"+tt.upstream.Listener.Addr().String())
+			if tt.options != nil {
+				var err error
+				u.TLSConfig, err = NewTLSConfig(*tt.options)
+				assert.NilError(t, err)
+			}
+			assert.NilError(t, u.Validate())
+
+			c, err := u.dial(context.Background(), "tcp", target.Listener.Addr().String())
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				assert.NilError(t, err)
+				assert.Equal(t, getThroughTunnel(t, c, target.URL), "hello")
+			}
+
+			req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+			assert.NilError(t, err)
+			resp, err := u.roundTrip(req)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, resp.StatusCode, http.StatusOK)
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	assert.NilError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+	tests := []struct {
+		name    string
+		options TLSOptions
+		wantErr string
+	}{
+		{"Empty", TLSOptions{}, ""},
+		{"MissingCAFile", TLSOptions{CAFile: filepath.Join(dir, "missing.pem")}, "failed to read CA file"},
+		{"InvalidCAFile", TLSOptions{CAFile: notPEM}, "no PEM certificate found"},
+		{"MissingKeyFile", TLSOptions{CertFile: notPEM}, "failed to load client certificate"},
+		{"ShortPin", TLSOptions{Pins: []string{"AB:CD"}}, `invalid pin "AB:CD"`},
+		{"NotHexPin", TLSOptions{Pins: []string{strings.Repeat("ZZ", 32)}}, "invalid pin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTLSConfig(tt.options)
+			if tt.wantErr == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultIdleTimeout is the IdleTimeout of upstreams not defining one
+const defaultIdleTimeout = 90 * time.Second
+
+// An Upstream is a proxy requests are forwarded to
+//
+// The scheme of its URL defines the protocol used to talk to the proxy ("http", "https", "socks4", "socks4a",
+// "socks5", "socks5h" or "ssh") and its user info the credentials to authenticate with.
+//
+// Upstreams should not be modified once used.
+type Upstream struct {
+	URL *url.URL
+	// Auth forces the authentication scheme used with HTTP proxies: "basic", "digest" or "ntlm".
+	// If empty, the scheme is negotiated from the proxy challenges and no credentials are sent before the first one.
+	Auth string
+	// TLSConfig is used for connections to https proxies, by default certificates are verified
+	// using the system roots. See NewTLSConfig to create one from TLSOptions.
+	TLSConfig *tls.Config
+	// SSHConfig is used for connections to ssh proxies, by default keys of the SSH agent are used
+	// and host keys are verified with ~/.ssh/known_hosts. See NewSSHConfig to create one from SSHOptions.
+	SSHConfig *ssh.ClientConfig
+	// KeepAlive is the interval of the keepalive requests detecting broken connections to ssh proxies,
+	// defaults to 30 seconds
+	KeepAlive time.Duration
+	// ConnectTimeout limits the time to establish connections to the proxy, zero means no timeout
+	ConnectTimeout time.Duration
+	// HandshakeTimeout limits the TLS handshake with https proxies, the SSH handshake with ssh proxies and
+	// the negotiation with SOCKS proxies, zero means no timeout
+	HandshakeTimeout time.Duration
+	// ResponseTimeout limits the time waiting for the proxy to answer CONNECT requests and to send the response
+	// headers of plain requests, zero means no timeout
+	ResponseTimeout time.Duration
+	// IdleTimeout is the maximum time idle connections to the proxy are kept for reuse, defaults to 90 seconds
+	IdleTimeout time.Duration
+	// BindAddress is the local address connections to the proxy are made from, the zero value lets the system choose
+	BindAddress netip.Addr
+	// HTTP2 multiplexes tunnels through https proxies supporting HTTP/2 over a single connection.
+	// Proxies using NTLM authentication are always reached using HTTP/1.1.
+	HTTP2 bool
+	// WarmConns is the number of connections to http and https proxies established ahead of tunnels
+	WarmConns int
+	// MaxConns limits the concurrent connections through the proxy shared by tunnels and plain requests,
+	// new ones wait for others to be closed (at most ConnectTimeout if set). Zero means no limit.
+	MaxConns int
+	// Via is the upstream connections to the proxy are tunneled through, it allows to chain proxies.
+	// ConnectTimeout and BindAddress are ignored when it is set.
+	Via *Upstream
+	// Group is set for upstreams dispatching connections to several proxies (see NewGroup)
+	Group *Group
+	// HealthCheck defines how the proxy is probed in the background while used by the active profile,
+	// nil disables health checks
+	HealthCheck *HealthCheck
+	// CircuitBreaker makes connections through the proxy fail fast while it keeps failing, nil disables it
+	CircuitBreaker *CircuitBreaker
+
+	mu        sync.Mutex
+	transport *http.Transport
+	// authScheme is the authentication scheme learned from the proxy challenges
+	authScheme atomic.Value
+	health     health
+	latency    latency
+	breaker    breaker
+	ssh        sshClient
+	pool       connPool
+	// tlsConf is the TLS configuration of https proxies, it holds a session cache to resume TLS sessions
+	tlsOnce sync.Once
+	tlsConf *tls.Config
+}
+
+// NewUpstream creates an Upstream with default options for the given proxy URL
+func NewUpstream(u *url.URL) *Upstream {
+	return &Upstream{URL: u}
+}
+
+// Chain links upstreams so that connections to each of them are tunneled through the previous one,
+// the last upstream is returned. Upstreams are modified and should not be already used.
+func Chain(hops ...*Upstream) (*Upstream, error) {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("empty proxy chain")
+	}
+	for i, hop := range hops {
+		if hop == nil || hop == Reject || hop.Group != nil {
+			return nil, fmt.Errorf("a proxy chain can only contain proxies")
+		}
+		if i > 0 {
+			if hop.Via != nil {
+				return nil, fmt.Errorf("proxy %s is already chained", hop.URL.Redacted())
+			}
+			hop.Via = hops[i-1]
+		}
+	}
+	return hops[len(hops)-1], nil
+}
+
+// Validate checks that the upstream protocol and options are supported
+func (u *Upstream) Validate() error {
+	if u.Group != nil {
+		return u.Group.Validate()
+	}
+	switch u.URL.Scheme {
+	case "http", "https":
+	case "socks4", "socks4a", "socks5", "socks5h", "ssh":
+		if u.Auth != "" {
+			return fmt.Errorf("auth scheme is only supported by http and https proxies")
+		}
+		if _, ok := u.URL.User.Password(); ok && strings.HasPrefix(u.URL.Scheme, "socks4") {
+			return fmt.Errorf("SOCKS4 proxies only support a user id, not a password")
+		}
+	default:
+		return fmt.Errorf("unsupported scheme %q for proxy %s", u.URL.Scheme, u.URL.Redacted())
+	}
+	if u.TLSConfig != nil && u.URL.Scheme != "https" {
+		return fmt.Errorf("tls options are only supported by https proxies")
+	}
+	if u.HTTP2 && u.URL.Scheme != "https" {
+		return fmt.Errorf("HTTP/2 is only supported by https proxies")
+	}
+	if u.WarmConns > 0 && u.URL.Scheme != "http" && u.URL.Scheme != "https" {
+		return fmt.Errorf("warm connections are only supported by http and https proxies")
+	}
+	if u.WarmConns < 0 || u.MaxConns < 0 {
+		return fmt.Errorf("warm and max connections can not be negative")
+	}
+	if u.SSHConfig != nil && u.URL.Scheme != "ssh" {
+		return fmt.Errorf("ssh options are only supported by ssh proxies")
+	}
+	if u.URL.Scheme == "ssh" && u.URL.User.Username() == "" {
+		return fmt.Errorf("ssh proxy %s requires a user", u.URL.Redacted())
+	}
+	switch u.Auth {
+	case "", authBasic, authDigest, authNTLM:
+	default:
+		return fmt.Errorf("unsupported auth scheme %q, should be one of %q, %q or %q", u.Auth, authBasic, authDigest, authNTLM)
+	}
+	if u.HealthCheck != nil {
+		if err := u.HealthCheck.Validate(); err != nil {
+			return err
+		}
+	}
+	if u.CircuitBreaker != nil {
+		return u.CircuitBreaker.Validate()
+	}
+	return nil
+}
+
+func (u *Upstream) dialer() *net.Dialer {
+	d := &net.Dialer{Timeout: u.ConnectTimeout}
+	if u.BindAddress.IsValid() {
+		d.LocalAddr = &net.TCPAddr{IP: u.BindAddress.AsSlice()}
+	}
+	return d
+}
+
+// dialForward opens a connection to addr, through the Via upstream for chained proxies
+func (u *Upstream) dialForward(ctx context.Context, network, addr string) (net.Conn, error) {
+	if u.Via != nil {
+		return u.Via.dial(ctx, network, addr)
+	}
+	return u.dialer().DialContext(ctx, network, addr)
+}
+
+// withTimeout returns a context done after timeout, or ctx itself if timeout is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timeoutError reports a step of a connection to the proxy (ie. "TLS handshake with") not completed in time,
+// or interrupted if ctx was done first
+func (u *Upstream) timeoutError(ctx context.Context, step string, timeout time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s upstream proxy %s interrupted: %w", step, u.URL.Redacted(), err)
+	}
+	return fmt.Errorf("%s upstream proxy %s timed out after %s: %w", step, u.URL.Redacted(), timeout, os.ErrDeadlineExceeded)
+}
+
+// handshake runs the negotiation of a new connection to the proxy, it is interrupted if it takes more
+// than HandshakeTimeout or if ctx is done. The connection is closed on errors.
+func (u *Upstream) handshake(ctx context.Context, c net.Conn, step string, negotiate func(ctx context.Context) error) error {
+	hctx, cancel := withTimeout(ctx, u.HandshakeTimeout)
+	defer cancel()
+	stop := context.AfterFunc(hctx, func() { _ = c.SetDeadline(aLongTimeAgo) })
+	err := negotiate(hctx)
+	// negotiate may also watch hctx itself and fail before the AfterFunc runs
+	if !stop() || (err != nil && hctx.Err() != nil) {
+		c.Close()
+		return u.timeoutError(ctx, step, u.HandshakeTimeout)
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+// tlsConfig returns the TLS configuration of connections to the proxy, TLS sessions are resumed
+// to speed up handshakes unless the configuration has its own session cache
+func (u *Upstream) tlsConfig() *tls.Config {
+	u.tlsOnce.Do(func() {
+		c := &tls.Config{}
+		if u.TLSConfig != nil {
+			c = u.TLSConfig.Clone()
+		}
+		if c.ServerName == "" {
+			c.ServerName = u.URL.Hostname()
+		}
+		if c.ClientSessionCache == nil {
+			c.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		}
+		u.tlsConf = c
+	})
+	return u.tlsConf
+}
+
+// proxyAddr returns the address of the proxy, including the default port of its scheme if needed
+func (u *Upstream) proxyAddr() string {
+	if u.URL.Port() != "" {
+		return u.URL.Host
+	}
+	return net.JoinHostPort(u.URL.Hostname(), defaultProxyPort(u.URL.Scheme))
+}
+
+// dialProxy opens a connection to the proxy, using TLS for https proxies with the given ALPN protocols
+func (u *Upstream) dialProxy(ctx context.Context, network string, protos ...string) (net.Conn, error) {
+	c, err := u.dialForward(ctx, network, u.proxyAddr())
+	if err != nil {
+		return nil, err
+	}
+	if u.URL.Scheme == "https" {
+		config := u.tlsConfig()
+		if len(protos) > 0 {
+			config = config.Clone()
+			config.NextProtos = protos
+		}
+		tlsConn := tls.Client(c, config)
+		err := u.handshake(ctx, c, "TLS handshake with", func(ctx context.Context) error {
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return fmt.Errorf("TLS handshake with proxy %s failed: %w", u.URL.Redacted(), err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		c = tlsConn
+	}
+	return c, nil
+}
+
+// getTransport returns the http.Transport forwarding plain requests through the proxy
+func (u *Upstream) getTransport() *http.Transport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.transport == nil {
+		idleTimeout := u.IdleTimeout
+		if idleTimeout == 0 {
+			idleTimeout = defaultIdleTimeout
+		}
+		u.transport = &http.Transport{
+			IdleConnTimeout:       idleTimeout,
+			ResponseHeaderTimeout: u.ResponseTimeout,
+		}
+		if isSocks(u.URL.Scheme) {
+			// plain requests are sent through tunnels so hostnames are resolved like for CONNECT requests
+			u.transport.DialContext = u.limitDial(u.dialSocks)
+		} else if u.URL.Scheme == "ssh" {
+			u.transport.DialContext = u.limitDial(u.dialSSH)
+		} else {
+			// credentials are added by roundTrip once the proxy asked for them
+			proxyURL := *u.URL
+			proxyURL.User = nil
+			u.transport.Proxy = http.ProxyURL(&proxyURL)
+			u.transport.GetProxyConnectHeader = func(context.Context, *url.URL, string) (http.Header, error) {
+				if u.URL.User == nil || u.authenticationScheme() != authBasic {
+					return nil, nil
+				}
+				auth, _ := proxyAuthorization(u.URL)
+				return http.Header{"Proxy-Authorization": {auth}}, nil
+			}
+			dialProxy := u.limitDial(func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return u.dialProxy(ctx, network)
+			})
+			u.transport.DialContext = dialProxy
+			// connections to https proxies use the upstream TLS configuration while
+			// TLSClientConfig applies to https origins
+			u.transport.DialTLSContext = dialProxy
+		}
+	}
+	return u.transport
+}
+
+// retire closes the connections to the proxy once the upstream is no longer used by the active profile,
+// the idle ones right away and the others once the tunnels using them are closed
+func (u *Upstream) retire() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.transport != nil {
+		u.transport.CloseIdleConnections()
+	}
+	u.retireSSHClient()
+	u.retireTunnelConns()
+}
+
+// dial connects to addr through the proxy, waiting for other connections to be closed if MaxConns is reached.
+// The context only limits the establishment of the tunnel.
+func (u *Upstream) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return u.limitDial(u.dialTunnel)(ctx, network, addr)
+}
+
+func (u *Upstream) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch u.URL.Scheme {
+	case "http", "https":
+		return u.dialHTTP(ctx, network, addr)
+	case "socks4", "socks4a", "socks5", "socks5h":
+		return u.dialSocks(ctx, network, addr)
+	case "ssh":
+		return u.dialSSH(ctx, network, addr)
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q for proxy %s", u.URL.Scheme, u.URL.Redacted())
+	}
+}
+
+// An UpstreamError is returned when an upstream proxy refuses a request
+type UpstreamError struct {
+	// Proxy is the redacted URL of the upstream proxy
+	Proxy string
+	// Status is the status line of the upstream proxy response (ie. "407 Proxy Authentication Required")
+	Status     string
+	StatusCode int
+	// Body is the content of the upstream proxy response
+	Body string
+}
+
+func (e *UpstreamError) Error() string {
+	if e.StatusCode == http.StatusProxyAuthRequired {
+		return fmt.Sprintf("upstream proxy %s requires authentication (%s), check the credentials of its definition", e.Proxy, e.Status)
+	}
+	msg := fmt.Sprintf("upstream proxy %s refused connection (%s)", e.Proxy, e.Status)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+// proxyAuthorization returns the value of a Proxy-Authorization header
+// using basic authentication with the proxy URL credentials
+func proxyAuthorization(proxy *url.URL) (string, bool) {
+	if proxy.User == nil {
+		return "", false
+	}
+	password, _ := proxy.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)), true
+}
+
+func (u *Upstream) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	pc := &proxyConn{ctx: ctx, upstream: u, network: network, tunnel: true}
+	if u.useHTTP2() {
+		cc, c, err := u.http2Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if cc != nil {
+			return u.dialHTTP2(ctx, cc, addr)
+		}
+		if c != nil {
+			pc.conn, pc.br = c, bufio.NewReader(c)
+		}
+	}
+	connect := func(auth string, _ bool) (*http.Response, error) {
+		connectReq := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if auth != "" {
+			connectReq.Header.Set("Proxy-Authorization", auth)
+		}
+		return pc.send(connectReq, false)
+	}
+
+	resp, err := u.authenticate(http.MethodConnect, addr, connect)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		defer pc.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return nil, err
+		}
+		return nil, &UpstreamError{
+			Proxy:      u.URL.Redacted(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	if pc.br.Buffered() > 0 {
+		// the target spoke first and its data was read along with the CONNECT response
+		return &bufferedConn{Conn: pc.conn, r: pc.br}, nil
+	}
+	return pc.conn, nil
+}